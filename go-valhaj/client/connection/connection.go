@@ -4,21 +4,64 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
+	"fmt"
 	"net"
 	"os"
+	"slices"
+	"strconv"
+
+	"lj.com/go-valhaj/client/database"
+	"lj.com/go-valhaj/client/reader"
 )
 
+// Option is applied to a connection once it is established, e.g. to authenticate.
+type Option func(conn net.Conn) error
+
+// WithAuth(): Authenticates the connection as the given user, the server's default user is used if the username is empty.
+func WithAuth(username, password string) Option {
+	return func(conn net.Conn) error {
+		query, err := authQuery(username, password)
+		if err != nil {
+			return err
+		}
+
+		// The reply is read before any other query is sent, so no buffered data is lost with the reader
+		res, err := database.Exec(conn, reader.NewReader(conn), query)
+		if err != nil {
+			return err
+		}
+		if len(res) != 1 || res[0].Kind != database.KindStatus {
+			return fmt.Errorf("authentication failed: %v", res)
+		}
+		return nil
+	}
+}
+
+// WithProtocol(): Switches the connection to the given protocol version. Protocol 2 sends and receives length-prefixed values, see database.ExecArgs().
+func WithProtocol(version int) Option {
+	return func(conn net.Conn) error {
+		res, err := database.Hello(conn, reader.NewReader(conn), version)
+		if err != nil {
+			return err
+		}
+		if !slices.Contains(res.Strings(), "protocol:"+strconv.Itoa(version)) {
+			return fmt.Errorf("protocol negotiation failed: %v", res)
+		}
+		return nil
+	}
+}
+
 // Connect(): Opens a new unencrypted connection to the server.
-func Connect(network, address string) (net.Conn, error) {
+func Connect(network, address string, options ...Option) (net.Conn, error) {
 	conn, err := net.Dial(network, address)
 	if err != nil {
 		return nil, err
 	}
-	return conn, nil
+	return apply(conn, options)
 }
 
 // ConnectTLS(): Opens a new encrypted connection based on mTLS authentication.
-func ConnectTLS(network, address, caFile, certFile, keyFile string) (net.Conn, error) {
+func ConnectTLS(network, address, caFile, certFile, keyFile string, options ...Option) (net.Conn, error) {
 	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
 	if err != nil {
 		return nil, err
@@ -47,7 +90,7 @@ func ConnectTLS(network, address, caFile, certFile, keyFile string) (net.Conn, e
 	if err != nil {
 		return nil, err
 	}
-	return conn, nil
+	return apply(conn, options)
 }
 
 // Disconnect(): Closes a given connection to the server.
@@ -57,3 +100,30 @@ func Disconnect(conn net.Conn) error {
 	}
 	return nil
 }
+
+// apply(): Applies the options to a new connection, closing it if one fails.
+func apply(conn net.Conn, options []Option) (net.Conn, error) {
+	for _, option := range options {
+		if err := option(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// authQuery(): Returns the 'AUTH' query, the password alone authenticates as the default user.
+func authQuery(username, password string) (string, error) {
+	password, err := database.Quote(password)
+	if err != nil {
+		return "", err
+	}
+	if username == "" {
+		return "AUTH " + password, nil
+	}
+	username, err = database.Quote(username)
+	if err != nil {
+		return "", err
+	}
+	return "AUTH " + username + " " + password, nil
+}
@@ -0,0 +1,108 @@
+package connection
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+)
+
+var (
+	errProxyHeaderLength  = errors.New("PROXY protocol header exceeds the length limit")
+	errProxyHeaderVersion = errors.New("PROXY protocol version must be 1 or 2")
+
+	proxySignature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+const (
+	proxyVersionCommand = 0x21 // Version 2, PROXY command
+	proxyInetStream     = 0x11
+	proxyInet6Stream    = 0x21
+	proxyUnspec         = 0x00
+	proxyTypeSSL        = 0x20
+	proxySubtypeSSLCN   = 0x22
+	proxyClientSSL      = 0x01
+	proxyClientCertConn = 0x02
+)
+
+// WithProxyHeader(): Sends a PROXY protocol header, forwarding the address of the client and, with version 2 only, the common name of its verified certificate (may be empty).
+// Servers only accept the header from trusted sources, so this is meant for proxies.
+func WithProxyHeader(version int, source, destination net.Addr, commonName string) Option {
+	return func(conn net.Conn) error {
+		var header []byte
+		var err error
+		switch version {
+		case 1:
+			header = ProxyHeaderV1(source, destination)
+		case 2:
+			header, err = ProxyHeader(source, destination, commonName)
+		default:
+			err = errProxyHeaderVersion
+		}
+		if err != nil {
+			return err
+		}
+		_, err = conn.Write(header)
+		return err
+	}
+}
+
+// ProxyHeader(): Builds a binary PROXY protocol version 2 header. Addresses other than TCP ones are sent as unspecified.
+func ProxyHeader(source, destination net.Addr, commonName string) ([]byte, error) {
+	header := append([]byte{}, proxySignature...)
+
+	src, srcOk := source.(*net.TCPAddr)
+	dst, dstOk := destination.(*net.TCPAddr)
+	var addresses []byte
+	family := byte(proxyUnspec)
+	if srcOk && dstOk && src.IP.To4() != nil && dst.IP.To4() != nil {
+		family = proxyInetStream
+		addresses = append(addresses, src.IP.To4()...)
+		addresses = append(addresses, dst.IP.To4()...)
+	} else if srcOk && dstOk {
+		family = proxyInet6Stream
+		addresses = append(addresses, src.IP.To16()...)
+		addresses = append(addresses, dst.IP.To16()...)
+	}
+	if family != proxyUnspec {
+		addresses = binary.BigEndian.AppendUint16(addresses, uint16(src.Port))
+		addresses = binary.BigEndian.AppendUint16(addresses, uint16(dst.Port))
+	}
+
+	// The SSL TLV carries the client flags, the verification result (0 means verified) and the common name as sub-TLV
+	var tlvs []byte
+	if commonName != "" {
+		value := []byte{proxyClientSSL | proxyClientCertConn, 0, 0, 0, 0}
+		value = appendTLV(value, proxySubtypeSSLCN, []byte(commonName))
+		tlvs = appendTLV(tlvs, proxyTypeSSL, value)
+	}
+
+	length := len(addresses) + len(tlvs)
+	if length > 0xffff {
+		return nil, errProxyHeaderLength
+	}
+	header = append(header, proxyVersionCommand, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(length))
+	header = append(header, addresses...)
+	return append(header, tlvs...), nil
+}
+
+// ProxyHeaderV1(): Builds a human-readable PROXY protocol version 1 header. Addresses other than TCP ones are sent as unknown.
+func ProxyHeaderV1(source, destination net.Addr) []byte {
+	src, srcOk := source.(*net.TCPAddr)
+	dst, dstOk := destination.(*net.TCPAddr)
+	if !srcOk || !dstOk {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	family := "TCP6"
+	if src.IP.To4() != nil && dst.IP.To4() != nil {
+		family = "TCP4"
+	}
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, src.IP, dst.IP, src.Port, dst.Port))
+}
+
+func appendTLV(b []byte, kind byte, value []byte) []byte {
+	b = append(b, kind)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(value)))
+	return append(b, value...)
+}
@@ -12,54 +12,69 @@ import (
 var (
 	errInvalidProtoCount = errors.New("invalid count protocol response format") // Cannot be empty (at least: "!X", len=2)
 	errInvalidQueryCount = errors.New("invalid query count")
+	errInvalidBulkLength = errors.New("invalid bulk length")
+	errNotInteger        = errors.New("reply is not an integer")
+	errNotLineSafe       = errors.New("argument can't be sent in a line, use ExecArgs() with protocol 2")
 
 	countMinMessage = 2
 )
 
-// Exec(): Sends a query to the server for processing, returning the response in a series of *n* fragments.
-func Exec(conn net.Conn, read *reader.Reader, query string) ([]string, error) {
-	var empty []string
-	var rescount int
-	var resproto string
-	var err error
+// Quote(): Returns the argument as it's written in a line query, quoted if it contains spaces. The server keeps quoted arguments verbatim,
+// so a quoted argument can't contain '"' or end with '\'. Empty arguments and line breaks can't be sent in a line at all, use ExecArgs() for those.
+func Quote(arg string) (string, error) {
+	if arg == "" || strings.ContainsAny(arg, "\r\n") {
+		return "", errNotLineSafe
+	}
+	if !strings.Contains(arg, " ") && arg[0] != '"' { // Unquoted arguments end at the next space, any other byte is kept
+		return arg, nil
+	}
+	if strings.Contains(arg, "\"") || strings.HasSuffix(arg, "\\") {
+		return "", errNotLineSafe
+	}
+	return "\"" + arg + "\"", nil
+}
 
+// Exec(): Sends a query to the server for processing, returning the response in a series of *n* typed replies.
+// The query is sent as a line, which only protocol 1 connections accept. Use ExecArgs() after switching to protocol 2.
+func Exec(conn net.Conn, read *reader.Reader, query string) (Result, error) {
 	// Send query
 	if _, err := conn.Write([]uint8(query + "\r\n")); err != nil {
-		return empty, err
+		return Result{}, err
 	}
+	return readResult(read, 1)
+}
 
-	// Get response
-	resproto, err = read.Read()
-	if err != nil {
-		return empty, err
-	}
-	if len(resproto) < countMinMessage {
-		return empty, errInvalidProtoCount
+// ExecArgs(): Sends a query as length-prefixed arguments, which may contain any bytes, returning the response in a series of *n* typed replies.
+// Requires protocol 2, see Hello().
+func ExecArgs(conn net.Conn, read *reader.Reader, args ...string) (Result, error) {
+	var query = make([]string, 0, len(args)*5+3)
+	query = append(query, "!", strconv.Itoa(len(args)), "\r\n")
+	for _, arg := range args {
+		query = append(query, "$", strconv.Itoa(len(arg)), "\r\n", arg, "\r\n")
 	}
 
-	rescount, err = strconv.Atoi(resproto[1:])
-	if err != nil {
-		return empty, err
+	// Send query
+	if _, err := conn.Write([]uint8(strings.Join(query, ""))); err != nil {
+		return Result{}, err
 	}
+	return readResult(read, 2)
+}
 
-	var response = make([]string, 0, rescount)
-	var fragment string
-	for i := 0; i < rescount; i++ {
-		fragment, err = read.Read()
-		if err != nil {
-			return empty, err
-		}
-		response = append(response, fragment)
+// Hello(): Switches a protocol 1 connection to the given protocol version, returning the details of the session. Protocol 2 supports ExecArgs() and length-prefixed values.
+// Use ExecArgs(conn, read, "HELLO", "1") to switch back.
+func Hello(conn net.Conn, read *reader.Reader, protocol int) (Result, error) {
+	// Send query, the response already uses the new protocol
+	if _, err := conn.Write([]uint8("HELLO " + strconv.Itoa(protocol) + "\r\n")); err != nil {
+		return Result{}, err
 	}
-
-	return response, nil
+	return readResult(read, protocol)
 }
 
-// ExecPipeline(): Sends a series of queries to the server for processing, returning the responses in a series of *i* times *n* fragments.
-func ExecPipeline(conn net.Conn, read *reader.Reader, queries []string) ([][]string, error) {
-	var empty [][]string
+// ExecPipeline(): Sends a series of queries to the server for processing, returning the responses in a series of *i* times *n* typed replies.
+// Like Exec(), it only works on protocol 1 connections.
+func ExecPipeline(conn net.Conn, read *reader.Reader, queries []string) ([]Result, error) {
+	var empty []Result
 	var cmdcount int
-	var rescount int
 
 	cmdcount = len(queries)
 	if queries == nil || cmdcount == 0 {
@@ -75,35 +90,70 @@ func ExecPipeline(conn net.Conn, read *reader.Reader, queries []string) ([][]str
 	}
 
 	// Get responses
-	var err error
-	var resproto string
-	var responses = make([][]string, 0, cmdcount)
+	var responses = make([]Result, 0, cmdcount)
 	for i := 0; i < cmdcount; i++ {
-		resproto, err = read.Read()
+		response, err := readResult(read, 1)
 		if err != nil {
 			return responses, err // Return the set of responses up until the error
 		}
-		if len(resproto) < countMinMessage {
-			return responses, errInvalidProtoCount
-		}
+		responses = append(responses, response)
+	}
+
+	return responses, nil
+}
 
-		rescount, err = strconv.Atoi(resproto[1:])
+// readResult(): Reads the count of a response and then its replies, encoded with the given protocol.
+func readResult(read *reader.Reader, protocol int) (Result, error) {
+	var empty Result
+
+	resproto, err := read.Read()
+	if err != nil {
+		return empty, err
+	}
+	if len(resproto) < countMinMessage {
+		return empty, errInvalidProtoCount
+	}
+
+	rescount, err := strconv.Atoi(resproto[1:])
+	if err != nil {
+		return empty, err
+	}
+
+	var response = make(Result, 0, rescount)
+	for i := 0; i < rescount; i++ {
+		reply, err := readReply(read, protocol, rescount == 1)
 		if err != nil {
-			return responses, err
+			return empty, err
 		}
+		response = append(response, reply)
+	}
+	return response, nil
+}
 
-		var response = make([]string, 0, rescount)
-		var fragment string
-		for j := 0; j < rescount; j++ {
-			fragment, err = read.Read()
-			if err != nil {
-				return responses, err
-			}
-			response = append(response, fragment)
+// readReply(): Reads a single reply. Protocol 2 prefixes values with their length, so they're never mistaken for other types.
+// With protocol 1, only single replies are typed by their prefix. Statuses, errors and integers are never part of several replies, those are values or nil (e.g. of 'SCAN' and 'MGET').
+func readReply(read *reader.Reader, protocol int, single bool) (Reply, error) {
+	line, err := read.Read()
+	if err != nil {
+		return Reply{}, err
+	}
+	if protocol < 2 {
+		if single || line == "$-1" {
+			return parseLine(line), nil
 		}
-
-		responses = append(responses, response)
+		return Reply{Kind: KindValue, Text: line}, nil
+	}
+	if !strings.HasPrefix(line, "$") || line == "$-1" {
+		return parseLine(line), nil
 	}
 
-	return responses, nil
+	length, err := strconv.Atoi(line[1:])
+	if err != nil || length < 0 {
+		return Reply{}, errInvalidBulkLength
+	}
+	value, err := read.ReadBulk(length)
+	if err != nil {
+		return Reply{}, err
+	}
+	return Reply{Kind: KindValue, Text: value}, nil
 }
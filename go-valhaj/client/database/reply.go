@@ -0,0 +1,99 @@
+package database
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Kind is the type of a reply.
+type Kind int
+
+const (
+	KindValue   Kind = iota // A value, which may be empty
+	KindNil                 // An absent value, e.g. of a missing key
+	KindStatus              // A status, e.g. '+OK'
+	KindError               // An error, e.g. '-ERR no such key'
+	KindInteger             // An integer, e.g. ':1'
+)
+
+// Reply is a single fragment of a response.
+type Reply struct {
+	Kind Kind
+	Text string // The value, or the status, error or integer without its prefix
+}
+
+// Result is the response to a query, consisting of *n* replies.
+type Result []Reply
+
+// parseLine(): Types a line of a response by its prefix. With protocol 1, a single value starting with a prefix can't be told apart, see readReply().
+func parseLine(line string) Reply {
+	switch {
+	case line == "$-1":
+		return Reply{Kind: KindNil}
+	case strings.HasPrefix(line, "+"):
+		return Reply{Kind: KindStatus, Text: line[1:]}
+	case strings.HasPrefix(line, "-ERR"):
+		return Reply{Kind: KindError, Text: line[1:]}
+	case strings.HasPrefix(line, ":"):
+		if _, err := strconv.ParseInt(line[1:], 10, 64); err == nil {
+			return Reply{Kind: KindInteger, Text: line[1:]}
+		}
+	}
+	return Reply{Kind: KindValue, Text: line}
+}
+
+// String(): Returns the reply as sent with protocol 1, e.g. '+OK' or '$-1' for nil.
+func (r Reply) String() string {
+	switch r.Kind {
+	case KindNil:
+		return "$-1"
+	case KindStatus:
+		return "+" + r.Text
+	case KindError:
+		return "-" + r.Text
+	case KindInteger:
+		return ":" + r.Text
+	}
+	return r.Text
+}
+
+// Nil(): Reports whether the value is absent, as opposed to empty.
+func (r Reply) Nil() bool {
+	return r.Kind == KindNil
+}
+
+// Err(): Returns the error the server replied with, nil for other replies.
+func (r Reply) Err() error {
+	if r.Kind != KindError {
+		return nil
+	}
+	return errors.New(r.Text)
+}
+
+// Int(): Returns the integer, also accepting values that are integers (e.g. the result of 'INCR').
+func (r Reply) Int() (int64, error) {
+	if r.Kind != KindInteger && r.Kind != KindValue {
+		return 0, errNotInteger
+	}
+	return strconv.ParseInt(r.Text, 10, 64)
+}
+
+// Err(): Returns the first error of the result, if any.
+func (res Result) Err() error {
+	for _, reply := range res {
+		if err := reply.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Strings(): Returns the replies as sent with protocol 1.
+func (res Result) Strings() []string {
+	lines := make([]string, 0, len(res))
+	for _, reply := range res {
+		lines = append(lines, reply.String())
+	}
+	return lines
+}
@@ -0,0 +1,94 @@
+package database
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+
+	"lj.com/go-valhaj/client/reader"
+)
+
+var (
+	errInvalidScanResponse = errors.New("invalid scan response")
+)
+
+// Scanner iterates over the keys of the selected database by issuing consecutive 'SCAN' commands.
+type Scanner struct {
+	conn    net.Conn
+	read    *reader.Reader
+	options string
+	cursor  string
+	keys    []string
+	key     string
+	done    bool
+	err     error
+}
+
+// NewScanner(): Returns a new Scanner. An empty match pattern returns every key, a count of zero uses the server's default.
+// The 'SCAN' commands are sent with Exec(), so the connection has to use protocol 1.
+func NewScanner(conn net.Conn, read *reader.Reader, match string, count int) *Scanner {
+	var options []string
+	var err error
+	if match != "" {
+		if match, err = Quote(match); err != nil { // Reported by Err(), the scan doesn't start
+			return &Scanner{err: err}
+		}
+		options = append(options, "MATCH", match)
+	}
+	if count > 0 {
+		options = append(options, "COUNT", strconv.Itoa(count))
+	}
+
+	return &Scanner{
+		conn:    conn,
+		read:    read,
+		options: strings.Join(options, " "),
+		cursor:  "0",
+	}
+}
+
+// Next(): Advances the scanner to the next key. Returns false when the scan is complete or an error occurred.
+func (s *Scanner) Next() bool {
+	for len(s.keys) == 0 {
+		if s.done || s.err != nil {
+			return false
+		}
+
+		query := strings.TrimSpace("SCAN " + s.cursor + " " + s.options)
+		response, err := Exec(s.conn, s.read, query)
+		if err != nil {
+			s.err = err
+			return false
+		}
+		if len(response) == 0 {
+			s.err = errInvalidScanResponse
+			return false
+		}
+		if err := response.Err(); err != nil {
+			s.err = err
+			return false
+		}
+
+		s.cursor = response[0].Text
+		s.keys = s.keys[:0]
+		for _, key := range response[1:] {
+			s.keys = append(s.keys, key.Text)
+		}
+		s.done = s.cursor == "0"
+	}
+
+	s.key = s.keys[0]
+	s.keys = s.keys[1:]
+	return true
+}
+
+// Key(): Returns the key the scanner currently points to.
+func (s *Scanner) Key() string {
+	return s.key
+}
+
+// Err(): Returns the first error encountered during the scan, if any.
+func (s *Scanner) Err() error {
+	return s.err
+}
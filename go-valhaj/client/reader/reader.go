@@ -3,6 +3,7 @@ package reader
 import (
 	"bufio"
 	"errors"
+	"io"
 	"net"
 )
 
@@ -41,6 +42,18 @@ func (r *Reader) Read() (string, error) {
 	return line[:lineLen-2], nil
 }
 
+// ReadBulk(): Reads a length-prefixed value of a protocol 2 response, following its '$<length>' line. The value is returned verbatim.
+func (r *Reader) ReadBulk(length int) (string, error) {
+	value := make([]byte, length+2)
+	if _, err := io.ReadFull(r.br, value); err != nil {
+		return "", err
+	}
+	if value[length] != '\r' || value[length+1] != '\n' {
+		return "", errIncompleteEmptyData
+	}
+	return string(value[:length]), nil
+}
+
 func (r *Reader) Reset() {
 	r.br.Reset(r.conn)
 }
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"lj.com/go-valhaj/client/connection"
+	"lj.com/go-valhaj/client/database"
+	"lj.com/go-valhaj/client/reader"
+)
+
+type keyStat struct {
+	key   string
+	value int
+}
+
+// ranking keeps the keys with the highest values, up to a fixed size.
+type ranking struct {
+	size  int
+	items []keyStat
+}
+
+func (r *ranking) add(key string, value int) {
+	if len(r.items) == r.size && value <= r.items[len(r.items)-1].value {
+		return
+	}
+	index := sort.Search(len(r.items), func(i int) bool { return r.items[i].value < value })
+	r.items = append(r.items, keyStat{})
+	copy(r.items[index+1:], r.items[index:])
+	r.items[index] = keyStat{key: key, value: value}
+	if len(r.items) > r.size {
+		r.items = r.items[:r.size]
+	}
+}
+
+func main() {
+	network := flag.String("network", "tcp", "network of the server, 'tcp' or 'unix'")
+	address := flag.String("address", "127.0.0.1:6380", "address of the server")
+	db := flag.String("db", "0", "name of the logical database to analyze")
+	user := flag.String("user", "", "user to authenticate as, the server's default user if empty")
+	password := flag.String("password", "", "password to authenticate with, authentication is skipped if empty")
+	bigKeys := flag.Bool("bigkeys", false, "report the largest keys by memory usage")
+	hotKeys := flag.Bool("hotkeys", false, "report the most frequently accessed keys")
+	top := flag.Int("top", 10, "number of keys to report")
+	count := flag.Int("count", 100, "number of keys inspected per batch")
+	interval := flag.Duration("interval", 0, "pause between batches to reduce the load on the server, e.g. 10ms")
+	flag.Parse()
+
+	if !*bigKeys && !*hotKeys {
+		*bigKeys, *hotKeys = true, true
+	}
+
+	var options []connection.Option
+	if *password != "" {
+		options = append(options, connection.WithAuth(*user, *password))
+	}
+	conn, err := connection.Connect(*network, *address, options...)
+	if err != nil {
+		log.Fatalf("error: %s", err)
+	}
+
+	read := reader.NewReader(conn)
+
+	if res, err := database.Exec(conn, read, "SELECT "+*db); err != nil || len(res) != 1 || res[0].Kind != database.KindStatus {
+		log.Fatalf("error: failed to select database %s: %v %v", *db, res, err)
+	}
+	fmt.Printf("Scanning the keyspace of database %s on %s\n\n", *db, *address)
+
+	// Keys are inspected in batches, pipelining the introspection commands of each batch
+	biggest := ranking{size: *top}
+	hottest := ranking{size: *top}
+	var scanned, skipped, totalBytes int
+	var batch []string
+	inspect := func() {
+		var keys, queries []string
+		for _, key := range batch {
+			arg, err := database.Quote(key)
+			if err != nil { // Keys that can't be sent in a line query aren't inspected
+				skipped++
+				continue
+			}
+			keys = append(keys, key)
+			if *bigKeys {
+				queries = append(queries, "MEMORY USAGE "+arg)
+			}
+			if *hotKeys {
+				queries = append(queries, "OBJECT FREQ "+arg)
+			}
+		}
+		scanned += len(batch)
+		batch = batch[:0]
+		if len(queries) == 0 {
+			return
+		}
+		responses, err := database.ExecPipeline(conn, read, queries)
+		if err != nil {
+			log.Fatalf("error: %s", err)
+		}
+
+		for i, key := range keys {
+			offset := i * len(queries) / len(keys)
+			if *bigKeys {
+				if size, ok := parseCount(responses[offset]); ok { // Keys deleted in the meantime return nil
+					biggest.add(key, size)
+					totalBytes += size
+				}
+				offset++
+			}
+			if *hotKeys {
+				if freq, ok := parseCount(responses[offset]); ok {
+					hottest.add(key, freq)
+				}
+			}
+		}
+		time.Sleep(*interval)
+	}
+
+	scanner := database.NewScanner(conn, read, "", *count)
+	for scanner.Next() {
+		batch = append(batch, scanner.Key())
+		if len(batch) == *count {
+			inspect()
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatalf("error: %s", err)
+	}
+	if len(batch) > 0 {
+		inspect()
+	}
+
+	fmt.Printf("Scanned %d keys\n", scanned)
+	if skipped > 0 {
+		fmt.Printf("Skipped %d keys that can't be sent in a line query\n", skipped)
+	}
+	if *bigKeys {
+		fmt.Printf("\nBiggest keys (%d bytes in total):\n", totalBytes)
+		for i, item := range biggest.items {
+			fmt.Printf("%3d) %s: %d bytes\n", i+1, item.key, item.value)
+		}
+	}
+	if *hotKeys {
+		fmt.Printf("\nHottest keys (logarithmic access frequency):\n")
+		for i, item := range hottest.items {
+			fmt.Printf("%3d) %s: %d\n", i+1, item.key, item.value)
+		}
+	}
+
+	// The distribution is based on the server's per-shard key counts
+	responses, err := database.Exec(conn, read, "DEBUG SHARDS")
+	if err != nil {
+		log.Fatalf("error: %s", err)
+	}
+	printDistribution(responses.Strings())
+
+	database.Exec(conn, read, "QUIT")
+
+	read.Reset()
+
+	if err := connection.Disconnect(conn); err != nil {
+		log.Fatalf("error: %s", err)
+	}
+}
+
+// printDistribution(): Summarizes the 'shard_n:keys=k,...' lines returned by 'DEBUG SHARDS' and reports the lock metrics.
+func printDistribution(responses []string) {
+	var counts []int
+	var locks []string
+	for _, response := range responses {
+		name, fields, found := strings.Cut(response, ":")
+		if !found {
+			continue
+		}
+		if strings.HasPrefix(name, "memory_lock_") {
+			locks = append(locks, response)
+			continue
+		}
+		if !strings.HasPrefix(name, "shard_") {
+			continue
+		}
+		keys, _, _ := strings.Cut(strings.TrimPrefix(fields, "keys="), ",")
+		if n, err := strconv.Atoi(keys); err == nil {
+			counts = append(counts, n)
+		}
+	}
+	if len(counts) == 0 {
+		fmt.Printf("\nNo shard distribution available: %v\n", responses)
+		return
+	}
+
+	total, lowest, highest := 0, math.MaxInt, 0
+	for _, n := range counts {
+		total += n
+		lowest = min(lowest, n)
+		highest = max(highest, n)
+	}
+	mean := float64(total) / float64(len(counts))
+	var variance float64
+	for _, n := range counts {
+		variance += (float64(n) - mean) * (float64(n) - mean)
+	}
+	variance /= float64(len(counts))
+
+	fmt.Printf("\nShard distribution (%d shards, %d keys):\n", len(counts), total)
+	fmt.Printf("min %d, max %d, mean %.1f, stddev %.1f\n", lowest, highest, mean, math.Sqrt(variance))
+	if mean > 0 {
+		fmt.Printf("imbalance (max/mean) %.2f\n", float64(highest)/mean)
+	}
+	if len(locks) > 0 {
+		fmt.Printf("\nShard locks:\n%s\n", strings.Join(locks, "\n"))
+	}
+}
+
+// parseCount(): Parses a single ':n' response.
+func parseCount(response database.Result) (int, bool) {
+	if len(response) != 1 || response[0].Kind != database.KindInteger {
+		return 0, false
+	}
+	n, err := response[0].Int()
+	return int(n), err == nil
+}
@@ -0,0 +1,75 @@
+// Compares the shard selection of the server (maphash with masking) against its predecessor (a single byte of SHA-1 modulo the shard count) and FNV-1a
+package main
+
+import (
+	"crypto/sha1"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"hash/maphash"
+	"math"
+	"strconv"
+	"testing"
+)
+
+type strategy struct {
+	name  string
+	index func(key string, shardCount int) int
+}
+
+var seed = maphash.MakeSeed()
+
+var strategies = []strategy{
+	{"sha1-byte-modulo", func(key string, shardCount int) int {
+		checksum := sha1.Sum([]byte(key))
+		return int(checksum[17]) % shardCount
+	}},
+	{"fnv1a-mask", func(key string, shardCount int) int {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		return int(h.Sum64() & uint64(shardCount-1))
+	}},
+	{"maphash-mask", func(key string, shardCount int) int {
+		return int(maphash.String(seed, key) & uint64(shardCount-1))
+	}},
+}
+
+func main() {
+	shardCount := flag.Int("shards", 64, "number of shards, must be a power of two")
+	keyCount := flag.Int("keys", 1000000, "number of keys used to measure the distribution")
+	prefix := flag.String("prefix", "", "prefix of the generated keys, e.g. 'user:'")
+	flag.Parse()
+
+	if *shardCount < 1 || *shardCount&(*shardCount-1) != 0 {
+		fmt.Println("error: the number of shards must be a power of two")
+		return
+	}
+
+	keys := make([]string, *keyCount)
+	for i := range keys {
+		keys[i] = *prefix + strconv.Itoa(i)
+	}
+
+	fmt.Printf("%d keys, %d shards\n\n", *keyCount, *shardCount)
+	fmt.Printf("%-18s %12s %12s %12s %10s\n", "strategy", "ns/key", "min", "max", "imbalance")
+	for _, s := range strategies {
+		result := testing.Benchmark(func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				s.index(keys[i%len(keys)], *shardCount)
+			}
+		})
+
+		counts := make([]int, *shardCount)
+		for _, key := range keys {
+			counts[s.index(key, *shardCount)]++
+		}
+		lowest, highest := math.MaxInt, 0
+		for _, n := range counts {
+			lowest = min(lowest, n)
+			highest = max(highest, n)
+		}
+		mean := float64(len(keys)) / float64(*shardCount)
+
+		fmt.Printf("%-18s %12.1f %12d %12d %10.2f\n", s.name, float64(result.T.Nanoseconds())/float64(result.N), lowest, highest, float64(highest)/mean)
+	}
+}
@@ -2,9 +2,11 @@ package main
 
 import (
 	"fmt"
+	"log"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"lj.com/valhaj-proxy/internal/config"
 	"lj.com/valhaj-proxy/internal/server"
@@ -19,14 +21,24 @@ func main() {
 		config.ReleaseAuthor,
 	)
 
+	// Load certificates, client certificates are always required
+	certificates, err := server.NewCertificates(config.ServerCAFile, config.ServerCertFile, config.ServerKeyFile, "require")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Certificates are reloaded on SIGHUP and whenever their files change
+	reloadChannel := make(chan os.Signal, 1)
+	signal.Notify(reloadChannel, syscall.SIGHUP)
+	go func() {
+		for range reloadChannel {
+			certificates.Reload()
+		}
+	}()
+	go certificates.Watch(config.ServerCertReloadInterval * time.Millisecond)
+
 	// Main server handling
-	s := server.NewServer(
-		config.ServerProxyNetwork,
-		config.ServerProxyAddress,
-		config.ServerCAFile,
-		config.ServerCertFile,
-		config.ServerKeyFile,
-	)
+	s := server.NewServer(config.ServerProxyNetwork, config.ServerProxyAddress, certificates.Config())
 	s.WG.Add(1)
 	go s.Serve()
 
@@ -10,9 +10,12 @@ const (
 	ServerProxyNetwork          = "tcp"
 	ServerProxyAddress          = "0.0.0.0:6380"
 	ServerDatabaseNetwork       = "unix"
-	ServerDatabaseAddress       = "/tmp/valhaj.sock"
+	ServerDatabaseAddress       = "../valhaj-server/sockets/proxy.sock" // The proxy listener of the server (ServerProxyAddress)
 	ServerCAFile                = "./ca-cert.pem"
 	ServerCertFile              = "./server-cert.pem"
 	ServerKeyFile               = "./server-key.pem"
 	ServerGracefulShutdownDelay = 1000
+	ServerHandshakeTimeout      = 5000
+	ServerProxyProtocol         = 2     // Forwards the client's address (and certificate with version 2) with a PROXY protocol header, 0 disables it. Only the proxy listener of the server trusts it
+	ServerCertReloadInterval    = 10000 // Checks the certificate files for changes, they're also reloaded on SIGHUP
 )
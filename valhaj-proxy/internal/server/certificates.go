@@ -0,0 +1,133 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Certificates holds the TLS configuration, which is reloaded without interrupting established sessions.
+type Certificates struct {
+	caFile, certFile, keyFile string
+	clientAuth                tls.ClientAuthType
+	current                   atomic.Pointer[tls.Config]
+	modTimes                  []time.Time // Of the files at the last attempt to load them
+	reloadLock                sync.Mutex
+}
+
+// NewCertificates(): Loads the server certificate and the CA certificates used to verify client certificates, as requested by clientAuth ("none", "optional" or "require").
+func NewCertificates(caFile, certFile, keyFile, clientAuth string) (*Certificates, error) {
+	c := &Certificates{caFile: caFile, certFile: certFile, keyFile: keyFile}
+	switch clientAuth {
+	case "none":
+		c.clientAuth = tls.NoClientCert
+	case "optional":
+		c.clientAuth = tls.VerifyClientCertIfGiven
+	case "require":
+		c.clientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("unknown client authentication mode '%s'", clientAuth)
+	}
+
+	c.modTimes = c.stat()
+	config, err := c.load()
+	if err != nil {
+		return nil, err
+	}
+	c.current.Store(config)
+	return c, nil
+}
+
+// Config(): Returns the configuration for the listener, every handshake uses the certificates loaded last.
+func (c *Certificates) Config() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS13,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return c.current.Load(), nil
+		},
+	}
+}
+
+// Reload(): Loads the certificates again. If that fails, the error is logged and the previous certificates stay in use.
+func (c *Certificates) Reload() {
+	c.reloadLock.Lock()
+	defer c.reloadLock.Unlock()
+
+	c.modTimes = c.stat()
+	config, err := c.load()
+	if err != nil {
+		log.Printf("Failed to reload TLS certificates, keeping the previous ones: %s\n", err)
+		return
+	}
+	c.current.Store(config)
+	log.Println("Reloaded TLS certificates")
+}
+
+// Watch(): Reloads the certificates whenever one of the files changes, checking every interval.
+func (c *Certificates) Watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		c.reloadLock.Lock()
+		modTimes := c.modTimes
+		c.reloadLock.Unlock()
+
+		current := c.stat()
+		for i := range current {
+			if !current[i].Equal(modTimes[i]) {
+				c.Reload()
+				break
+			}
+		}
+	}
+}
+
+// stat(): Returns the modification times of the files, zero for files that can't be accessed.
+func (c *Certificates) stat() []time.Time {
+	files := []string{c.certFile, c.keyFile}
+	if c.clientAuth != tls.NoClientCert {
+		files = append(files, c.caFile)
+	}
+	modTimes := make([]time.Time, len(files))
+	for i, file := range files {
+		if info, err := os.Stat(file); err == nil {
+			modTimes[i] = info.ModTime()
+		}
+	}
+	return modTimes
+}
+
+func (c *Certificates) load() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   c.clientAuth,
+		MinVersion:   tls.VersionTLS13,
+		Rand:         rand.Reader,
+	}
+	if c.clientAuth == tls.NoClientCert {
+		return &config, nil
+	}
+
+	// Load the CA certificate that signed the client certificates
+	clientCA, err := os.ReadFile(c.caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	certPool := x509.NewCertPool() // Only this CA, a certificate of any public CA would otherwise authenticate as a user
+	if !certPool.AppendCertsFromPEM(clientCA) {
+		return nil, errors.New("failed to append the client CA certificate to the certificate pool")
+	}
+	config.ClientCAs = certPool
+	return &config, nil
+}
@@ -1,13 +1,10 @@
 package server
 
 import (
-	"crypto/rand"
 	"crypto/tls"
-	"crypto/x509"
 	"io"
 	"log"
 	"net"
-	"os"
 	"strconv"
 	"strings"
 	"sync"
@@ -26,36 +23,9 @@ type Server struct {
 	WG       sync.WaitGroup
 }
 
-// NewServer(): Creates a new server instance.
-func NewServer(network, address, caFile, certFile, keyFile string) *Server {
-	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	// Load the CA certificate that signed the client certificate
-	clientCA, err := os.ReadFile(caFile)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	certPool, _ := x509.SystemCertPool()
-	if certPool == nil {
-		certPool = x509.NewCertPool()
-	}
-
-	if !certPool.AppendCertsFromPEM(clientCA) {
-		log.Fatal("failed to append the client CA certificate to the certificate pool")
-	}
-
-	config := tls.Config{
-		ClientCAs:    certPool,
-		Certificates: []tls.Certificate{cert},
-		ClientAuth:   tls.RequireAndVerifyClientCert,
-		MinVersion:   tls.VersionTLS13,
-		Rand:         rand.Reader,
-	}
-	listener, err := tls.Listen(network, address, &config)
+// NewServer(): Creates a new server instance, terminating TLS with the given configuration.
+func NewServer(network, address string, tlsConfig *tls.Config) *Server {
+	listener, err := tls.Listen(network, address, tlsConfig)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -90,25 +60,49 @@ func (s *Server) Serve() {
 				log.Printf("Error: %s\n", err)
 			}
 		} else {
-			dbConn, err := connection.Connect(config.ServerDatabaseNetwork, config.ServerDatabaseAddress)
-			if err != nil {
-				log.Printf("Error: %s\n", err)
-				syscall.Kill(syscall.Getpid(), syscall.SIGINT)
-			} else {
-				s.WG.Add(1)
-				go func() {
-					s.StartSession(conn, dbConn)
-					s.WG.Done()
-					if err := connection.Disconnect(dbConn); err != nil {
-						log.Printf("Error: %s\n", err)
-						syscall.Kill(syscall.Getpid(), syscall.SIGINT)
-					}
-				}()
-			}
+			s.WG.Add(1)
+			go func() {
+				defer s.WG.Done()
+				dbConn, err := s.connectDatabase(conn)
+				if err != nil {
+					log.Printf("Error: %s\n", err)
+					conn.Close()
+					return
+				}
+				s.StartSession(conn, dbConn)
+				if err := connection.Disconnect(dbConn); err != nil {
+					log.Printf("Error: %s\n", err)
+					syscall.Kill(syscall.Getpid(), syscall.SIGINT)
+				}
+			}()
 		}
 	}
 }
 
+// connectDatabase(): Completes the TLS handshake with the client and connects to the database, forwarding the client's address and certificate.
+func (s *Server) connectDatabase(conn net.Conn) (net.Conn, error) {
+	tlsConn := conn.(*tls.Conn)
+	tlsConn.SetDeadline(time.Now().Add(config.ServerHandshakeTimeout * time.Millisecond))
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+
+	var options []connection.Option
+	if config.ServerProxyProtocol != 0 {
+		var commonName string
+		if chains := tlsConn.ConnectionState().VerifiedChains; len(chains) > 0 {
+			commonName = chains[0][0].Subject.CommonName
+		}
+		options = append(options, connection.WithProxyHeader(config.ServerProxyProtocol, conn.RemoteAddr(), conn.LocalAddr(), commonName))
+	}
+	dbConn, err := connection.Connect(config.ServerDatabaseNetwork, config.ServerDatabaseAddress, options...)
+	if err != nil {
+		syscall.Kill(syscall.Getpid(), syscall.SIGINT) // The database is unreachable
+		return nil, err
+	}
+	return dbConn, nil
+}
+
 // StartSession(): Runs the client's session. Reads and executes commands and writes responses back to the client.
 func (s *Server) StartSession(conn, dbConn net.Conn) {
 	defer func() {
@@ -141,6 +135,17 @@ SessionLoop:
 				}
 			}
 
+			if strings.HasPrefix(line, "*") { // The arguments of the RESP array follow on separate lines
+				_, _ = conn.Write([]uint8("-ERR (PRX) RESP is not supported by the proxy\r\n"))
+				return
+			}
+			if switchesProtocol(line) {
+				if _, err = conn.Write([]uint8("!1\r\n" + "-ERR (PRX) unsupported protocol version\r\n")); err != nil {
+					return
+				}
+				continue SessionLoop
+			}
+
 			responses, err := database.Exec(dbConn, dbRd, line)
 			if err != nil { // TODO: Fully exit on error
 				_, _ = conn.Write([]uint8("!1\r\n" + "-ERR (PRX) " + err.Error() + "\r\n"))
@@ -152,7 +157,7 @@ SessionLoop:
 			var fwResponses = make([]string, 0, maxSize)
 			fwResponses = append(fwResponses, "!", strconv.Itoa(rescount), "\r\n")
 			for _, response := range responses {
-				fwResponses = append(fwResponses, response, "\r\n")
+				fwResponses = append(fwResponses, response.String(), "\r\n")
 			}
 
 			fwResponse := strings.Join(fwResponses, "")
@@ -164,3 +169,13 @@ SessionLoop:
 		}
 	}
 }
+
+// switchesProtocol(): Reports whether the line is a 'HELLO <protover>' command switching away from protocol 1. The proxy forwards replies line by line, so it only supports protocol 1.
+func switchesProtocol(line string) bool {
+	fields := strings.Fields(line)
+	if (len(fields) != 2 && len(fields) != 5) || strings.ToUpper(fields[0]) != "HELLO" {
+		return false
+	}
+	protover := strings.ToUpper(fields[1])
+	return protover != "1" && protover != "AUTH"
+}
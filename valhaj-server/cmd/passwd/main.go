@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"lj.com/valhaj/internal/auth"
+	"lj.com/valhaj/internal/memory"
+)
+
+func main() { // Prints a line for the users file, the password is read from stdin
+	user := flag.String("user", "default", "name of the user")
+	namespace := flag.String("namespace", "", "namespace the user is confined to, unrestricted if empty")
+	rules := flag.String("rules", "allcommands allkeys alldbs", "access rules of the user, e.g. '+@read ~cache:* db=0'")
+	flag.Parse()
+
+	if !auth.ValidName(*user) {
+		log.Fatalf("error: invalid user name '%s'", *user)
+	}
+	if *namespace != "" && !memory.ValidName(*namespace) {
+		log.Fatalf("error: invalid namespace '%s'", *namespace)
+	}
+
+	fmt.Fprintf(os.Stderr, "Password for %s: ", *user)
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && password == "" {
+		log.Fatalf("error: %s", err)
+	}
+	password = strings.TrimRight(password, "\r\n")
+	if password == "" {
+		log.Fatalf("error: empty password")
+	}
+
+	hash, err := auth.HashPassword(password)
+	if err != nil {
+		log.Fatalf("error: %s", err)
+	}
+	fields := []string{*user, "on", "#" + hash}
+	if *namespace != "" {
+		fields = append(fields, "ns="+*namespace)
+	}
+	fields = append(fields, strings.Fields(*rules)...)
+	fmt.Println(strings.Join(fields, " "))
+}
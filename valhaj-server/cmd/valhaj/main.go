@@ -1,14 +1,18 @@
 package main
 
 import (
+	"crypto/tls"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
+	"lj.com/valhaj/internal/auth"
 	"lj.com/valhaj/internal/config"
 	"lj.com/valhaj/internal/memory"
+	"lj.com/valhaj/internal/proxyproto"
 	"lj.com/valhaj/internal/server"
 	"lj.com/valhaj/internal/statistics"
 	"lj.com/valhaj/internal/storage"
@@ -26,6 +30,15 @@ func main() {
 	// Initialize statistics
 	statistics.StartTime, statistics.ProcessId = statistics.InitStats()
 
+	// Load users
+	userCount, err := auth.LoadUsers(config.AuthACLFile)
+	if err != nil {
+		log.Fatalf("Failed to load users: %s\n", err)
+	}
+	if auth.Enabled() {
+		log.Printf("Loaded %d user(s), authentication is required\n", userCount)
+	}
+
 	// Create caches
 	memory.Container = memory.NewCacheContainer(config.MemoryCacheContainerSize, config.MemoryCacheShardCount)
 
@@ -33,15 +46,60 @@ func main() {
 	storage.RestoreState()
 
 	// Main server handling
-	s := server.NewServer(config.ServerInetNetwork, config.ServerInetAddress)
+	var tlsConfig *tls.Config
+	if config.ServerTLS {
+		certificates, err := server.NewCertificates(config.ServerTLSCAFile, config.ServerTLSCertFile, config.ServerTLSKeyFile, config.ServerTLSClientAuth)
+		if err != nil {
+			log.Fatalf("Failed to load TLS certificates: %s\n", err)
+		}
+		tlsConfig = certificates.Config()
+
+		// Certificates are reloaded on SIGHUP and whenever their files change
+		reloadChannel := make(chan os.Signal, 1)
+		signal.Notify(reloadChannel, syscall.SIGHUP)
+		go func() {
+			for range reloadChannel {
+				certificates.Reload()
+			}
+		}()
+		go certificates.Watch(config.ServerTLSReloadInterval * time.Millisecond)
+	}
+	trustedProxies, err := proxyproto.ParseSources(config.ServerTrustedProxies)
+	if err != nil {
+		log.Fatalf("Failed to parse the trusted proxies: %s\n", err)
+	}
+	s := server.NewServer(config.ServerInetNetwork, config.ServerInetAddress, tlsConfig)
+	s.TrustedProxies = trustedProxies
 	s.WG.Add(1)
 	go s.Serve()
 
+	// Administrative sessions, no longer derived from the client's address
+	var admin *server.Server
+	if config.ServerAdminAddress != "" {
+		admin = server.NewAdminServer(config.ServerAdminNetwork, config.ServerAdminAddress)
+		admin.WG.Add(1)
+		go admin.Serve()
+	}
+
+	// Sessions of valhaj-proxy, trusted with the PROXY protocol header
+	var proxy *server.Server
+	if config.ServerProxyAddress != "" {
+		proxy = server.NewProxyServer(config.ServerProxyNetwork, config.ServerProxyAddress)
+		proxy.WG.Add(1)
+		go proxy.Serve()
+	}
+
 	quitChannel := make(chan os.Signal, 1)
 	signal.Notify(quitChannel, syscall.SIGINT, syscall.SIGTERM)
 	<-quitChannel
 	fmt.Printf("\n")
 	s.Quit()
+	if admin != nil {
+		admin.Quit()
+	}
+	if proxy != nil {
+		proxy.Quit()
+	}
 
 	// Write snapshots to disk
 	storage.SaveState()
@@ -0,0 +1,283 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"lj.com/valhaj/internal/glob"
+	"lj.com/valhaj/internal/memory"
+)
+
+var (
+	// Categories are the command categories rules may refer to with '+@<category>' and '-@<category>', besides '@all'.
+	Categories = []string{"read", "write", "admin", "dangerous"}
+
+	errUnknownRule     = errors.New("unknown rule")
+	errUnknownCategory = errors.New("unknown command category")
+	errInvalidRule     = errors.New("invalid rule argument")
+	errUserInactive    = errors.New("user is disabled")
+	errNoKeyAccess     = errors.New("no permissions to access a key used by the command")
+	errNoDBAccess      = errors.New("no permissions to access the database")
+)
+
+// User is granted access by rules, which are applied in order:
+//
+//	on, off                    enables or disables the user, new users are disabled
+//	>password, #hash, nopass   sets the password (stored as hash) or removes it, users without a password can't authenticate
+//	ns=name                    confines the sessions of the user to a namespace, 'ns=' lifts the restriction
+//	+@category, -@category     allows or denies the commands of a category, '@all' covers every command
+//	+command, -command         allows or denies a command, or a subcommand in the form 'command|subcommand'
+//	allcommands, nocommands    same as '+@all' and '-@all'
+//	~pattern, allkeys          allows keys matching the glob-style pattern, 'allkeys' is the same as '~*'
+//	db=pattern, alldbs         allows databases matching the glob-style pattern, 'alldbs' is the same as 'db=*'
+//	resetkeys, resetdbs        revokes the access to all keys or databases
+//	reset                      revokes everything, disables the user and removes its password
+type User struct {
+	Name    string
+	lock    sync.RWMutex
+	removed bool // Set once deleted, so sessions still referring to the user lose their authentication
+	permissions
+}
+
+type permissions struct {
+	enabled   bool
+	hash      string
+	namespace string
+	commands  []string // Command rules in order, the last matching rule decides
+	keys      []string
+	databases []string
+}
+
+// Active(): Reports whether the user is enabled and wasn't deleted.
+func (user *User) Active() bool {
+	user.lock.RLock()
+	defer user.lock.RUnlock()
+	return user.enabled && !user.removed
+}
+
+// Namespace(): Returns the namespace the user is confined to, empty if unrestricted.
+func (user *User) Namespace() string {
+	user.lock.RLock()
+	defer user.lock.RUnlock()
+	return user.namespace
+}
+
+// Permit(): Checks whether the user may run the command (in the form 'command' or 'command|subcommand') of the given categories, using the keys and database.
+func (user *User) Permit(command string, categories []string, keys []string, database string) error {
+	user.lock.RLock()
+	defer user.lock.RUnlock()
+	if !user.enabled || user.removed {
+		return errUserInactive
+	}
+	if !user.commandPermitted(strings.ToLower(command), categories) {
+		return fmt.Errorf("no permissions to run the '%s' command", strings.ToLower(command))
+	}
+	for _, key := range keys {
+		if !matchAny(user.keys, key) {
+			return errNoKeyAccess
+		}
+	}
+	if database != "" && !matchAny(user.databases, database) {
+		return errNoDBAccess
+	}
+	return nil
+}
+
+// PermitDatabase(): Checks whether the user may access the database, e.g. before selecting it.
+func (user *User) PermitDatabase(database string) error {
+	user.lock.RLock()
+	defer user.lock.RUnlock()
+	if !matchAny(user.databases, database) {
+		return errNoDBAccess
+	}
+	return nil
+}
+
+// PermitKey(): Reports whether the user may access the key, used to filter the keys returned by 'SCAN', 'KEYS' and 'RANDOMKEY'.
+func (user *User) PermitKey(key string) bool {
+	user.lock.RLock()
+	defer user.lock.RUnlock()
+	return matchAny(user.keys, key)
+}
+
+// Describe(): Returns the user as a line of the users file, the rules reproduce the user when applied.
+func (user *User) Describe() string {
+	user.lock.RLock()
+	defer user.lock.RUnlock()
+	fields := []string{user.Name, "off"}
+	if user.enabled {
+		fields[1] = "on"
+	}
+	if user.hash != "" {
+		fields = append(fields, "#"+user.hash)
+	}
+	if user.namespace != "" {
+		fields = append(fields, "ns="+user.namespace)
+	}
+	for _, pattern := range user.keys {
+		fields = append(fields, "~"+pattern)
+	}
+	for _, pattern := range user.databases {
+		fields = append(fields, "db="+pattern)
+	}
+	return strings.Join(append(fields, user.commands...), " ")
+}
+
+// Details(): Returns the settings of the user as 'name:value' lines, the password hash is left out.
+func (user *User) Details() []string {
+	user.lock.RLock()
+	defer user.lock.RUnlock()
+	enabled, password := "off", "none"
+	if user.enabled {
+		enabled = "on"
+	}
+	if user.hash != "" {
+		password = "set"
+	}
+	return []string{
+		"name:" + user.Name,
+		"enabled:" + enabled,
+		"password:" + password,
+		"namespace:" + user.namespace,
+		"commands:" + strings.Join(user.commands, " "),
+		"keys:" + strings.Join(user.keys, " "),
+		"databases:" + strings.Join(user.databases, " "),
+	}
+}
+
+// current(): Returns a copy of the permissions, apply() doesn't modify the slices of the copy.
+func (user *User) current() permissions {
+	user.lock.RLock()
+	defer user.lock.RUnlock()
+	return user.permissions
+}
+
+// apply(): Applies the rules in order. Either all of them are applied or, if one is invalid, none.
+func (user *User) apply(rules []string) error {
+	user.lock.Lock()
+	defer user.lock.Unlock()
+
+	p := user.permissions
+	p.commands = slices.Clone(p.commands)
+	p.keys = slices.Clone(p.keys)
+	p.databases = slices.Clone(p.databases)
+	for _, rule := range rules {
+		if err := p.apply(rule); err != nil {
+			return fmt.Errorf("error in rule '%s' (%w)", rule, err)
+		}
+	}
+	user.permissions = p
+	return nil
+}
+
+func (p *permissions) apply(rule string) error {
+	switch rule {
+	case "on":
+		p.enabled = true
+	case "off":
+		p.enabled = false
+	case "nopass":
+		p.hash = ""
+	case "allcommands":
+		p.commands = []string{"+@all"}
+	case "nocommands":
+		p.commands = nil
+	case "allkeys":
+		p.keys = []string{"*"}
+	case "resetkeys":
+		p.keys = nil
+	case "alldbs":
+		p.databases = []string{"*"}
+	case "resetdbs":
+		p.databases = nil
+	case "reset":
+		*p = permissions{}
+	default:
+		return p.applyArgument(rule)
+	}
+	return nil
+}
+
+// applyArgument(): Applies the rules carrying an argument, like '>password' or '~pattern'.
+func (p *permissions) applyArgument(rule string) error {
+	if len(rule) < 2 {
+		return errUnknownRule
+	}
+	switch {
+	case rule[0] == '>':
+		hash, err := HashPassword(rule[1:])
+		if err != nil {
+			return err
+		}
+		p.hash = hash
+	case rule[0] == '#':
+		if _, _, _, err := parseHash(rule[1:]); err != nil {
+			return err
+		}
+		p.hash = rule[1:]
+	case rule[0] == '~':
+		p.keys = appendUnique(p.keys, rule[1:])
+	case strings.HasPrefix(rule, "db="):
+		if len(rule) == 3 {
+			return errInvalidRule
+		}
+		p.databases = appendUnique(p.databases, rule[3:])
+	case strings.HasPrefix(rule, "ns="):
+		if len(rule) > 3 && !memory.ValidName(rule[3:]) {
+			return errInvalidRule
+		}
+		p.namespace = rule[3:]
+	case rule[0] == '+' || rule[0] == '-':
+		name := strings.ToLower(rule[1:])
+		if category, ok := strings.CutPrefix(name, "@"); ok {
+			if category == "all" {
+				p.commands = []string{rule[:1] + name} // Overrides all of the previous rules
+				return nil
+			}
+			if !slices.Contains(Categories, category) {
+				return errUnknownCategory
+			}
+		}
+		p.commands = append(slices.DeleteFunc(p.commands, func(r string) bool { return r[1:] == name }), rule[:1]+name)
+	default:
+		return errUnknownRule
+	}
+	return nil
+}
+
+// commandPermitted(): Evaluates the command rules, the last one matching the command, its parent command or one of its categories decides.
+func (p *permissions) commandPermitted(command string, categories []string) bool {
+	allowed := false
+	for _, rule := range p.commands {
+		name := rule[1:]
+		var matches bool
+		if category, ok := strings.CutPrefix(name, "@"); ok {
+			matches = category == "all" || slices.Contains(categories, category)
+		} else {
+			matches = name == command || strings.HasPrefix(command, name+"|")
+		}
+		if matches {
+			allowed = rule[0] == '+'
+		}
+	}
+	return allowed
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if glob.Match(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func appendUnique(list []string, item string) []string {
+	if slices.Contains(list, item) {
+		return list
+	}
+	return append(list, item)
+}
@@ -0,0 +1,326 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	users     = make(map[string]*User)
+	usersFile string // Where the users were loaded from, changes made with 'ACL SETUSER' and 'ACL DELUSER' are saved to it
+	usersLock sync.RWMutex
+	enabled   bool
+
+	errMalformedHash = errors.New("malformed password hash")
+	errInvalidName   = errors.New("invalid user name")
+
+	dummyUser = &User{permissions: permissions{hash: mustHash("")}} // Verified against for unknown users, so they can't be told apart by timing
+)
+
+const (
+	hashScheme     = "pbkdf2-sha256"
+	hashIterations = 100000
+	saltLength     = 16
+	keyLength      = 32
+)
+
+// Enabled(): Reports whether clients have to authenticate, which is the case if the users file exists.
+func Enabled() bool {
+	return enabled
+}
+
+// LoadUsers(): Reads the users file, one user per line: '<name> [rule ...]'. A missing file isn't an error, it disables authentication.
+func LoadUsers(filename string) (int, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("error opening users file (%w)", err)
+	}
+	defer file.Close()
+
+	loaded := make(map[string]*User)
+	scanner := bufio.NewScanner(file)
+	for row := 1; scanner.Scan(); row++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if !ValidName(fields[0]) {
+			return 0, fmt.Errorf("error parsing users file in line %d (%w)", row, errInvalidName)
+		}
+		user := &User{Name: fields[0]}
+		if err := user.apply(fields[1:]); err != nil {
+			return 0, fmt.Errorf("error parsing users file in line %d (%w)", row, err)
+		}
+		loaded[user.Name] = user
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, fmt.Errorf("error reading users file (%w)", err)
+	}
+
+	usersLock.Lock()
+	users, usersFile, enabled = loaded, filename, true
+	usersLock.Unlock()
+	return len(loaded), nil
+}
+
+// saveUsers(): Writes all users back to the users file, with the changed user in place of the one of the same name (if any).
+// The file is replaced at once, so it's never left incomplete. The caller has to hold the users lock for writing, so saves don't overlap.
+func saveUsers(changed *User) error {
+	var b strings.Builder
+	b.WriteString("# Managed by valhaj, changes made with 'ACL SETUSER' and 'ACL DELUSER' overwrite this file\n")
+	names := sortedNames()
+	if changed != nil {
+		if _, ok := users[changed.Name]; !ok {
+			names = append(names, changed.Name)
+			slices.Sort(names)
+		}
+	}
+	for _, name := range names {
+		user := users[name]
+		if changed != nil && name == changed.Name {
+			user = changed
+		}
+		b.WriteString(user.Describe())
+		b.WriteString("\n")
+	}
+
+	temporary := usersFile + ".tmp"
+	if err := os.WriteFile(temporary, []byte(b.String()), 0600); err != nil {
+		return fmt.Errorf("error writing users file (%w)", err)
+	}
+	if err := os.Rename(temporary, usersFile); err != nil {
+		return fmt.Errorf("error replacing users file (%w)", err)
+	}
+	return nil
+}
+
+// Authenticate(): Returns the user if it's enabled and the password matches.
+func Authenticate(name, password string) (*User, bool) {
+	usersLock.RLock()
+	user, ok := users[name]
+	usersLock.RUnlock()
+	if !ok {
+		dummyUser.verify(password)
+		return nil, false
+	}
+	return user, user.verify(password) && user.Active()
+}
+
+// CertificateUser(): Returns the enabled user named by the common name or a subject alternative name of a verified client certificate.
+func CertificateUser(cert *x509.Certificate) (*User, bool) {
+	names := []string{cert.Subject.CommonName}
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	return IdentityUser(names...)
+}
+
+// IdentityUser(): Returns the first enabled user matching one of the names of a verified identity, e.g. forwarded by a proxy.
+func IdentityUser(names ...string) (*User, bool) {
+	for _, name := range names {
+		if user, ok := LookupUser(name); ok && user.Active() {
+			return user, true
+		}
+	}
+	return nil, false
+}
+
+// LookupUser(): Returns the user with the given name.
+func LookupUser(name string) (*User, bool) {
+	usersLock.RLock()
+	defer usersLock.RUnlock()
+	user, ok := users[name]
+	return user, ok
+}
+
+// ListUsers(): Returns all users, sorted by name.
+func ListUsers() []*User {
+	usersLock.RLock()
+	defer usersLock.RUnlock()
+	list := make([]*User, 0, len(users))
+	for _, name := range sortedNames() {
+		list = append(list, users[name])
+	}
+	return list
+}
+
+// SetUser(): Applies the rules to the user, creating it if it doesn't exist, and saves the users file.
+// Either all rules are applied or none, and the change only takes effect once it was saved.
+func SetUser(name string, rules []string) error {
+	if !ValidName(name) {
+		return errInvalidName
+	}
+	usersLock.Lock()
+	defer usersLock.Unlock()
+	user, ok := users[name]
+	changed := &User{Name: name}
+	if ok {
+		changed.permissions = user.current()
+	}
+	if err := changed.apply(rules); err != nil {
+		return err
+	}
+	if err := saveUsers(changed); err != nil {
+		return err
+	}
+	if !ok {
+		users[name] = changed
+		return nil
+	}
+	user.lock.Lock()
+	user.permissions = changed.permissions
+	user.lock.Unlock()
+	return nil
+}
+
+// DeleteUsers(): Removes the users and saves the users file, their sessions lose their authentication. Returns the number of users that existed.
+// If the file can't be saved, none of them is removed.
+func DeleteUsers(names []string) (int, error) {
+	usersLock.Lock()
+	defer usersLock.Unlock()
+	deleted := make(map[string]*User)
+	for _, name := range names {
+		if user, ok := users[name]; ok {
+			deleted[name] = user
+			delete(users, name)
+		}
+	}
+	if len(deleted) == 0 {
+		return 0, nil
+	}
+	if err := saveUsers(nil); err != nil {
+		for name, user := range deleted {
+			users[name] = user
+		}
+		return 0, err
+	}
+	for _, user := range deleted {
+		user.lock.Lock()
+		user.removed = true
+		user.lock.Unlock()
+	}
+	return len(deleted), nil
+}
+
+// ValidName(): Reports whether the name may be used for a user, it must not be empty or contain whitespace, quotes or '#'.
+func ValidName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, " \t\r\n#\"")
+}
+
+// HashPassword(): Returns the salted hash of the password, as stored in the users file.
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, saltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := pbkdf2([]byte(password), salt, hashIterations, keyLength)
+	return strings.Join([]string{
+		hashScheme,
+		strconv.Itoa(hashIterations),
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	}, "$"), nil
+}
+
+func mustHash(password string) string {
+	hash, err := HashPassword(password)
+	if err != nil {
+		panic(err)
+	}
+	return hash
+}
+
+// sortedNames(): Returns the names of all users in order. The caller has to hold the users lock.
+func sortedNames() []string {
+	names := make([]string, 0, len(users))
+	for name := range users {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func (user *User) verify(password string) bool {
+	user.lock.RLock()
+	hash := user.hash
+	user.lock.RUnlock()
+	if hash == "" { // Users without a password can't authenticate, but take as long as the others
+		dummyUser.verify(password)
+		return false
+	}
+	iterations, salt, key, err := parseHash(hash)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(pbkdf2([]byte(password), salt, iterations, len(key)), key) == 1
+}
+
+// parseHash(): Splits a hash of the form 'pbkdf2-sha256$<iterations>$<salt>$<key>' into its parameters.
+func parseHash(hash string) (int, []byte, []byte, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != hashScheme {
+		return 0, nil, nil, errMalformedHash
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations < 1 {
+		return 0, nil, nil, errMalformedHash
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return 0, nil, nil, errMalformedHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil || len(key) == 0 {
+		return 0, nil, nil, errMalformedHash
+	}
+	return iterations, salt, key, nil
+}
+
+// pbkdf2(): Derives a key from the password as specified by RFC 8018, using HMAC-SHA256.
+func pbkdf2(password, salt []byte, iterations, length int) []byte {
+	prf := hmac.New(sha256.New, password)
+	hashLength := prf.Size()
+	blocks := (length + hashLength - 1) / hashLength
+
+	var index [4]byte
+	key := make([]byte, 0, blocks*hashLength)
+	u := make([]byte, hashLength)
+	for block := 1; block <= blocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(index[:], uint32(block))
+		prf.Write(index[:])
+		key = prf.Sum(key)
+
+		t := key[len(key)-hashLength:]
+		copy(u, t)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range u {
+				t[j] ^= u[j]
+			}
+		}
+	}
+	return key[:length]
+}
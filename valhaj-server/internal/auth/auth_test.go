@@ -0,0 +1,221 @@
+package auth
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// loadTestUsers(): Loads a users file with the given lines from a temporary directory, returning its path.
+func loadTestUsers(t *testing.T, lines ...string) string {
+	filename := filepath.Join(t.TempDir(), "users.acl")
+	if err := os.WriteFile(filename, []byte(strings.Join(lines, "\n")), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadUsers(filename); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestPermissionsApply(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules []string
+		want  string // Describe() of the resulting user
+	}{
+		{"empty", nil, "alice off"},
+		{"enabled", []string{"on"}, "alice on"},
+		{"disabled again", []string{"on", "off"}, "alice off"},
+		{"commands", []string{"+@read", "-keys", "+acl|whoami"}, "alice off +@read -keys +acl|whoami"},
+		{"repeated command", []string{"+get", "-set", "-GET"}, "alice off -set -get"},
+		{"all commands", []string{"+get", "+@all", "-flushdb"}, "alice off +@all -flushdb"},
+		{"no commands", []string{"+get", "nocommands"}, "alice off"},
+		{"keys", []string{"~user:*", "~user:*", "~cache:*"}, "alice off ~user:* ~cache:*"},
+		{"reset keys", []string{"~user:*", "resetkeys", "allkeys"}, "alice off ~*"},
+		{"databases", []string{"db=1", "db=2", "db=1"}, "alice off db=1 db=2"},
+		{"all databases", []string{"db=1", "alldbs"}, "alice off db=*"},
+		{"namespace", []string{"ns=tenant", "ns=other"}, "alice off ns=other"},
+		{"no namespace", []string{"ns=tenant", "ns="}, "alice off"},
+		{"reset", []string{"on", "allkeys", "+@all", "reset"}, "alice off"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			user := &User{Name: "alice"}
+			if err := user.apply(test.rules); err != nil {
+				t.Fatal(err)
+			}
+			if got := user.Describe(); got != test.want {
+				t.Fatalf("got '%s', want '%s'", got, test.want)
+			}
+		})
+	}
+
+	// Either all rules are applied or none
+	for _, rules := range [][]string{{"on", "bogus"}, {"on", "+@bogus"}, {"on", "db="}, {"on", "ns=a b"}, {"on", "#nohash"}, {"on", "x"}} {
+		user := &User{Name: "alice"}
+		if err := user.apply(rules); err == nil {
+			t.Fatalf("rules %q were accepted", rules)
+		}
+		if got := user.Describe(); got != "alice off" {
+			t.Fatalf("rules %q were partially applied: '%s'", rules, got)
+		}
+	}
+}
+
+func TestCommandPermitted(t *testing.T) {
+	tests := []struct {
+		rules      []string
+		command    string
+		categories []string
+		want       bool
+	}{
+		{nil, "get", []string{"read"}, false},
+		{[]string{"+@all"}, "flushall", []string{"admin", "dangerous"}, true},
+		{[]string{"+@read"}, "get", []string{"read"}, true},
+		{[]string{"+@read"}, "set", []string{"write"}, false},
+		{[]string{"+@all", "-@dangerous"}, "flushdb", []string{"write", "dangerous"}, false},
+		{[]string{"-@dangerous", "+flushdb"}, "flushdb", []string{"write", "dangerous"}, true},
+		{[]string{"+acl"}, "acl|setuser", []string{"admin"}, true},
+		{[]string{"+acl", "-acl|setuser"}, "acl|setuser", []string{"admin"}, false},
+		{[]string{"+acl|whoami"}, "acl|setuser", []string{"admin"}, false},
+		{[]string{"+acl|whoami"}, "acl", []string{"admin"}, false},
+		{[]string{"+get"}, "getset", []string{"write"}, false}, // Only whole names match
+	}
+	for _, test := range tests {
+		user := &User{Name: "alice"}
+		if err := user.apply(test.rules); err != nil {
+			t.Fatal(err)
+		}
+		if got := user.commandPermitted(test.command, test.categories); got != test.want {
+			t.Errorf("rules %q, command '%s': got %v, want %v", test.rules, test.command, got, test.want)
+		}
+	}
+}
+
+func TestPermit(t *testing.T) {
+	user := &User{Name: "alice"}
+	if err := user.apply([]string{"on", "+@all", "~user:*", "~cache:?", "db=1", "db=tenant*"}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		keys     []string
+		database string
+		want     error
+	}{
+		{[]string{"user:1", "cache:a"}, "1", nil},
+		{[]string{"user:1", "cache:ab"}, "1", errNoKeyAccess},
+		{[]string{"session:1"}, "1", errNoKeyAccess},
+		{nil, "tenant-a", nil},
+		{nil, "0", errNoDBAccess},
+		{nil, "", nil}, // Commands that don't use a database
+	}
+	for _, test := range tests {
+		if err := user.Permit("get", []string{"read"}, test.keys, test.database); err != test.want {
+			t.Errorf("keys %q, database '%s': got %v, want %v", test.keys, test.database, err, test.want)
+		}
+	}
+	if err := user.PermitDatabase("2"); err != errNoDBAccess {
+		t.Fatalf("got %v, want %v", err, errNoDBAccess)
+	}
+	if user.PermitKey("session:1") {
+		t.Fatal("key outside of the patterns was permitted")
+	}
+
+	disabled := &User{Name: "bob"}
+	if err := disabled.apply([]string{"off", "+@all", "allkeys", "alldbs"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := disabled.Permit("get", []string{"read"}, []string{"key"}, "0"); err != errUserInactive {
+		t.Fatalf("got %v, want %v", err, errUserInactive)
+	}
+}
+
+func TestDeleteUsers(t *testing.T) {
+	filename := loadTestUsers(t, "alice on nopass +@all ~* db=*", "bob on nopass +@read ~* db=*")
+	alice, ok := LookupUser("alice")
+	if !ok {
+		t.Fatal("user wasn't loaded")
+	}
+
+	deleted, err := DeleteUsers([]string{"alice", "nobody"})
+	if err != nil || deleted != 1 {
+		t.Fatalf("got %d deleted and error %v, want 1 deleted", deleted, err)
+	}
+	// Sessions still referring to the user lose their permissions at once
+	if alice.Active() {
+		t.Fatal("deleted user is still active")
+	}
+	if err := alice.Permit("get", []string{"read"}, []string{"key"}, "0"); err != errUserInactive {
+		t.Fatalf("got %v, want %v", err, errUserInactive)
+	}
+	if _, ok := LookupUser("alice"); ok {
+		t.Fatal("deleted user can still be looked up")
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "alice") || !strings.Contains(string(data), "bob") {
+		t.Fatalf("users file wasn't updated: %s", data)
+	}
+}
+
+func TestSaveFailure(t *testing.T) {
+	filename := loadTestUsers(t, "alice on nopass +@read ~* db=*")
+	alice, _ := LookupUser("alice")
+	if err := os.RemoveAll(filepath.Dir(filename)); err != nil { // The users file can't be written anymore
+		t.Fatal(err)
+	}
+
+	if err := SetUser("alice", []string{"+@all"}); err == nil {
+		t.Fatal("change was saved")
+	}
+	if alice.commandPermitted("flushall", []string{"admin", "dangerous"}) {
+		t.Fatal("change took effect although it wasn't saved")
+	}
+	if err := SetUser("bob", []string{"on", "nopass"}); err == nil {
+		t.Fatal("new user was saved")
+	}
+	if _, ok := LookupUser("bob"); ok {
+		t.Fatal("new user was created although it wasn't saved")
+	}
+	if _, err := DeleteUsers([]string{"alice"}); err == nil {
+		t.Fatal("deletion was saved")
+	}
+	if _, ok := LookupUser("alice"); !ok || !alice.Active() {
+		t.Fatal("user was deleted although it wasn't saved")
+	}
+}
+
+func TestConcurrentSaves(t *testing.T) {
+	filename := loadTestUsers(t)
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- SetUser(fmt.Sprintf("user%02d", i), []string{"on", "nopass", "+@read"})
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The last save contains every user
+	count, err := LoadUsers(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 20 {
+		t.Fatalf("got %d users in the file, want 20", count)
+	}
+}
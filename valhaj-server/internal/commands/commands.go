@@ -1,26 +1,106 @@
 package commands
 
 import (
+	"errors"
+	"math"
+	"math/bits"
 	"net"
 	"slices"
 	"strconv"
 	"strings"
-	"sync"
 	"syscall"
 	"time"
 
+	"lj.com/valhaj/internal/auth"
 	"lj.com/valhaj/internal/config"
+	"lj.com/valhaj/internal/glob"
+	"lj.com/valhaj/internal/hyperloglog"
 	"lj.com/valhaj/internal/memory"
 	"lj.com/valhaj/internal/statistics"
+	"lj.com/valhaj/internal/storage"
 	"lj.com/valhaj/internal/writer"
 )
 
+var (
+	errNotInteger       = errors.New("value is either not an integer or too large")
+	errNotFloat         = errors.New("value is not a valid float")
+	errFloatRange       = errors.New("increment would produce NaN or Infinity")
+	errCounterSyntax    = errors.New("wrong syntax for counter options")
+	errCounterLimit     = errors.New("counter bounds are either not integers or invalid")
+	errCounterBounds    = errors.New("value would exceed the counter bounds")
+	errAuthDisabled     = errors.New("authentication is disabled, no users are configured")
+	errAuthFailed       = errors.New("invalid username or password")
+	errAuthFailures     = errors.New("too many failed authentication attempts")
+	errUnknownUser      = errors.New("no such user")
+	errNotAuthenticated = errors.New("session isn't authenticated")
+	errProtocolVersion  = errors.New("unsupported protocol version")
+
+	oomCommands = []string{ // Commands that may increase memory usage, rejected if the memory limit can't be upheld
+		"MSET", "SET", "INCR", "DECR", "INCRBY", "DECRBY", "INCRBYFLOAT", "APPEND", "PREPEND", "SETRANGE",
+		"COPY", "GETSET", "PFADD", "PFMERGE", "SETBIT", "BITOP",
+	}
+	authCommands = []string{ // Commands available before authenticating
+		"AUTH", "HELLO", "QUIT",
+	}
+	sessionCommands = []string{ // Commands that don't need the selected database, hence work after it was dropped
+		"SELECT", "DB", "SWAPDB", "FLUSHALL", "ECHO", "PING", "QUIT", "SHUTDOWN", "AUTH", "HELLO", "ACL",
+	}
+	databaseCommands = []string{ // Commands that affect the entire database, hence would reach beyond a namespace
+		"FLUSH", "FLUSHALL", "SWAPDB", "DBSIZE", "RESHARD", "DEBUG",
+	}
+	subcommandCommands = []string{ // Commands whose subcommands are permitted individually, as 'command|subcommand'
+		"DB", "ACL",
+	}
+	commandCategories = map[string][]string{ // Categories of the commands for the ACL. Commands without one are available to every authenticated user, missing commands to none
+		"AUTH": {}, "HELLO": {}, "QUIT": {}, "ECHO": {}, "PING": {}, "SELECT": {}, "NAMESPACE": {}, "ACL|WHOAMI": {},
+		"GET": {"read"}, "MGET": {"read"}, "LEN": {"read"}, "STRLEN": {"read"}, "GETRANGE": {"read"}, "EXISTS": {"read"},
+		"PFCOUNT": {"read"}, "GETBIT": {"read"}, "BITCOUNT": {"read"}, "BITPOS": {"read"}, "SCAN": {"read"},
+		"MEMORY": {"read"}, "OBJECT": {"read"}, "DBSIZE": {"read"}, "INFO": {"read"}, "DB|LIST": {"read"},
+		"KEYS": {"read", "dangerous"}, "RANDOMKEY": {"read", "dangerous"},
+		"SET": {"write"}, "MSET": {"write"}, "GETSET": {"write"}, "GETDEL": {"write"}, "INCR": {"write"}, "DECR": {"write"},
+		"INCRBY": {"write"}, "DECRBY": {"write"}, "INCRBYFLOAT": {"write"}, "APPEND": {"write"}, "PREPEND": {"write"},
+		"SETRANGE": {"write"}, "RENAME": {"write"}, "COPY": {"write"}, "DEL": {"write"}, "PFADD": {"write"},
+		"PFMERGE": {"write"}, "SETBIT": {"write"}, "BITOP": {"write"}, "MOVE": {"write"},
+		"FLUSH": {"write", "admin", "dangerous"}, "FLUSHALL": {"write", "admin", "dangerous"}, "SWAPDB": {"admin", "dangerous"},
+		"RESHARD": {"admin", "dangerous"}, "DEBUG": {"admin", "dangerous"}, "SHUTDOWN": {"admin", "dangerous"},
+		"DB|CREATE": {"admin"}, "DB|DROP": {"admin", "dangerous"},
+		"ACL|LIST": {"admin"}, "ACL|GETUSER": {"admin"}, "ACL|SETUSER": {"admin", "dangerous"}, "ACL|DELUSER": {"admin", "dangerous"},
+	}
+	keyArguments = map[string]keySpec{ // Positions of the key arguments, which are prefixed within a namespace
+		"MOVE": {1, 1, 1}, "GET": {1, 1, 1}, "SET": {1, 1, 1}, "GETSET": {1, 1, 1}, "GETDEL": {1, 1, 1},
+		"INCR": {1, 1, 1}, "DECR": {1, 1, 1}, "INCRBY": {1, 1, 1}, "DECRBY": {1, 1, 1}, "INCRBYFLOAT": {1, 1, 1},
+		"APPEND": {1, 1, 1}, "PREPEND": {1, 1, 1}, "STRLEN": {1, 1, 1}, "GETRANGE": {1, 1, 1}, "SETRANGE": {1, 1, 1},
+		"PFADD": {1, 1, 1}, "SETBIT": {1, 1, 1}, "GETBIT": {1, 1, 1}, "BITCOUNT": {1, 1, 1}, "BITPOS": {1, 1, 1},
+		"RENAME": {1, 2, 1}, "COPY": {1, 2, 1},
+		"MGET": {1, -1, 1}, "LEN": {1, -1, 1}, "DEL": {1, -1, 1}, "EXISTS": {1, -1, 1}, "PFCOUNT": {1, -1, 1}, "PFMERGE": {1, -1, 1},
+		"MSET":   {1, -1, 2},
+		"BITOP":  {2, -1, 1},
+		"MEMORY": {2, 2, 1}, "OBJECT": {2, 2, 1},
+	}
+
+	bitOffsetLimit   = 1 << 32 // Caps bitmap and ranged values at 512MB
+	scanDefaultCount = 10      // Default number of keys per 'SCAN' call
+	shardLimit       = 1 << 16 // Maximum number of shards per database, which also bounds 'SCAN' cursors
+)
+
 // Command implements the behavior of the commands.
 type Command struct {
 	Arguments  []string
 	Connection net.Conn
-	Index      int
-	Database   memory.ShardedCache
+	Writer     *writer.Writer // Buffers the replies of the session
+	Selected   string         // Name of the selected database
+	Database   *memory.ShardedCache
+	Namespace  string     // Prefixes the keys of the session, empty if there's none. Changed by the 'NAMESPACE' command
+	User       *auth.User // Authenticated user, nil unless authenticated. Changed by the 'AUTH' and 'HELLO' commands
+	Admin      bool       // Session of the admin listener, which neither needs to authenticate nor is restricted by the ACL
+	Protocol   int        // Protocol version of the session, 1 (line-based) or 2 (length-prefixed). Changed by the 'HELLO' command
+	RESP       int        // RESP version (2 or 3) if the command was sent by a Redis client, 0 otherwise. Changed by the 'HELLO' command
+	Failures   int        // Failed authentications of the session, which is closed once AuthMaxFailures is reached. Changed by the 'AUTH' and 'HELLO' commands
+}
+
+// keySpec describes which arguments are keys, from first to last (-1 is the last argument) in steps.
+type keySpec struct {
+	first, last, step int
 }
 
 // Empty(): Checks if the command is empty, hence unnecessary.
@@ -29,15 +109,62 @@ func (cmd *Command) Empty() bool {
 }
 
 // Execute(): Executes the command and writes the response. Returns false when the connection should be closed.
-func (cmd *Command) Execute() (int, bool) {
+func (cmd *Command) Execute() (string, bool) {
 	command := strings.ToUpper(cmd.Arguments[0])
+	if cmd.RESP != 0 { // The reply is encoded for the Redis client
+		cmd.Writer.SetRESP(cmd.RESP)
+		defer cmd.Writer.SetRESP(0)
+	}
+	if cmd.User != nil && !cmd.User.Active() { // Disabled or deleted meanwhile
+		cmd.User = nil
+	}
+	if auth.Enabled() && cmd.User == nil && !cmd.Admin && !slices.Contains(authCommands, command) {
+		cmd.Writer.Error("authentication required")
+		return cmd.Selected, true
+	}
+	if slices.Contains(oomCommands, command) && !memory.Container.FreeMemory() {
+		cmd.Writer.Error("OOM command not allowed when used memory exceeds the limit")
+		return cmd.Selected, true
+	}
+	if cmd.Namespace != "" {
+		if slices.Contains(databaseCommands, command) {
+			cmd.Writer.Error("command not allowed within a namespace")
+			return cmd.Selected, true
+		}
+		cmd.prefixKeys(command)
+	}
+	if cmd.User != nil && !cmd.Admin {
+		if err := cmd.permit(command); err != nil {
+			cmd.Writer.Error(err.Error())
+			return cmd.Selected, true
+		}
+	}
+	if cmd.Database == nil && !slices.Contains(sessionCommands, command) {
+		cmd.Writer.Error("selected database no longer exists")
+		return cmd.Selected, true
+	}
+
 	switch command {
+	case "AUTH":
+		return cmd.authCommand()
+	case "HELLO":
+		return cmd.helloCommand()
 	case "SELECT":
 		return cmd.selectCommand()
+	case "NAMESPACE":
+		return cmd.namespaceCommand()
+	case "ACL":
+		return cmd.aclCommand()
+	case "DB":
+		return cmd.dbCommand()
 	case "FLUSHALL":
 		return cmd.flushallCommand()
 	case "MOVE":
 		return cmd.moveCommand()
+	case "SWAPDB":
+		return cmd.swapdbCommand()
+	case "DBSIZE":
+		return cmd.dbsizeCommand()
 	case "MGET":
 		return cmd.mgetCommand()
 	case "MSET":
@@ -50,12 +177,24 @@ func (cmd *Command) Execute() (int, bool) {
 		return cmd.incrCommand()
 	case "DECR":
 		return cmd.decrCommand()
+	case "INCRBY":
+		return cmd.incrbyCommand()
+	case "DECRBY":
+		return cmd.decrbyCommand()
+	case "INCRBYFLOAT":
+		return cmd.incrbyfloatCommand()
 	case "APPEND":
 		return cmd.appendCommand()
 	case "PREPEND":
 		return cmd.prependCommand()
 	case "LEN":
 		return cmd.lenCommand()
+	case "STRLEN":
+		return cmd.strlenCommand()
+	case "GETRANGE":
+		return cmd.getrangeCommand()
+	case "SETRANGE":
+		return cmd.setrangeCommand()
 	case "RENAME":
 		return cmd.renameCommand()
 	case "COPY":
@@ -68,266 +207,479 @@ func (cmd *Command) Execute() (int, bool) {
 		return cmd.delCommand()
 	case "EXISTS":
 		return cmd.existsCommand()
+	case "PFADD":
+		return cmd.pfaddCommand()
+	case "PFCOUNT":
+		return cmd.pfcountCommand()
+	case "PFMERGE":
+		return cmd.pfmergeCommand()
+	case "SETBIT":
+		return cmd.setbitCommand()
+	case "GETBIT":
+		return cmd.getbitCommand()
+	case "BITCOUNT":
+		return cmd.bitcountCommand()
+	case "BITPOS":
+		return cmd.bitposCommand()
+	case "BITOP":
+		return cmd.bitopCommand()
+	case "SCAN":
+		return cmd.scanCommand()
+	case "KEYS":
+		return cmd.keysCommand()
+	case "RANDOMKEY":
+		return cmd.randomkeyCommand()
+	case "MEMORY":
+		return cmd.memoryCommand()
+	case "OBJECT":
+		return cmd.objectCommand()
 	case "QUIT":
 		return cmd.quitCommand()
 	case "INFO":
 		return cmd.infoCommand()
 	case "ECHO":
 		return cmd.echoCommand()
+	case "PING":
+		return cmd.pingCommand()
+	case "DEBUG":
+		return cmd.debugCommand()
+	case "RESHARD":
+		return cmd.reshardCommand()
 	case "FLUSH":
 		return cmd.flushCommand()
 	case "SHUTDOWN":
 		return cmd.shutdownCommand()
 	default:
-		responses := []string{"!1\r\n", "-ERR unknown command '", command, "'\r\n"}
-		if _, wErr := cmd.Connection.Write(writer.BuildResponse(responses)); wErr != nil {
-			return cmd.Index, false
-		}
+		cmd.Writer.Error("unknown command '" + command + "'")
 	}
-	return cmd.Index, true
+	return cmd.Selected, true
 }
 
-/* multi-database commands */
+/* connection commands */
 
-// selectCommand(): Select the active logical database for the current session.
-func (cmd *Command) selectCommand() (int, bool) {
-	var wErr error
-	var responses []string
+// authCommand(): Authenticates the session as the given user, or the 'default' user if omitted.
+func (cmd *Command) authCommand() (string, bool) {
+	clen := len(cmd.Arguments)
+	if clen < 2 || clen > 3 {
+		cmd.Writer.Error("wrong number of arguments for '" + cmd.Arguments[0] + "' command")
+		return cmd.Selected, true
+	}
 
-	if len(cmd.Arguments) != 2 {
-		responses = []string{"!1\r\n", "-ERR wrong number of arguments for '", cmd.Arguments[0], "' command\r\n"}
-		if _, wErr = cmd.Connection.Write(writer.BuildResponse(responses)); wErr != nil {
-			return cmd.Index, false
+	name, password := "default", cmd.Arguments[1]
+	if clen == 3 {
+		name, password = cmd.Arguments[1], cmd.Arguments[2]
+	}
+	if err := cmd.authenticate(name, password); err != nil {
+		cmd.Writer.Error(err.Error())
+		return cmd.Selected, err != errAuthFailures
+	}
+
+	cmd.Writer.OK()
+	return cmd.Selected, true
+}
+
+// helloCommand(): Returns details about the server and the session (including the client's address). 'HELLO <protover>' switches the protocol of the session, 'HELLO [protover] AUTH user password' authenticates first.
+// Redis clients switch between RESP2 and RESP3 instead.
+func (cmd *Command) helloCommand() (string, bool) {
+	args := cmd.Arguments[1:]
+	protocol, minProtocol, maxProtocol := cmd.Protocol, 1, 2
+	if cmd.RESP != 0 { // Redis clients choose the RESP version
+		protocol, minProtocol, maxProtocol = cmd.RESP, 2, 3
+	}
+	current := protocol
+	var err error
+	if (len(args) == 1 || len(args) == 4) && strings.ToUpper(args[0]) != "AUTH" {
+		if protocol, err = strconv.Atoi(args[0]); err != nil || protocol < minProtocol || protocol > maxProtocol {
+			protocol, err = current, errProtocolVersion
 		}
-		return cmd.Index, true
+		args = args[1:]
+	}
+	if len(args) != 0 && len(args) != 3 {
+		cmd.Writer.Error("wrong number of arguments for '" + cmd.Arguments[0] + "' command")
+		return cmd.Selected, true
 	}
 
-	newIndex, err := strconv.Atoi(cmd.Arguments[1])
+	if err == nil && len(args) == 3 {
+		if strings.ToUpper(args[0]) != "AUTH" {
+			err = errors.New("wrong syntax for 'hello' command")
+		} else {
+			err = cmd.authenticate(args[1], args[2])
+		}
+	} else if err == nil && auth.Enabled() && cmd.User == nil && !cmd.Admin {
+		err = errors.New("authentication required")
+	}
 	if err != nil {
-		responses = []string{"!1\r\n", "-ERR index value is not an integer\r\n"}
-		if _, wErr = cmd.Connection.Write(writer.BuildResponse(responses)); wErr != nil {
-			return cmd.Index, false
+		cmd.Writer.Error(err.Error())
+		return cmd.Selected, err != errAuthFailures
+	}
+	if cmd.RESP != 0 { // The reply already uses the new protocol
+		cmd.RESP = protocol
+		cmd.Writer.SetRESP(protocol)
+	} else {
+		cmd.Protocol = protocol
+		cmd.Writer.SetProtocol(protocol)
+	}
+
+	var user string
+	if cmd.User != nil {
+		user = cmd.User.Name
+	}
+	details := []string{
+		strings.Join([]string{"server:", config.ReleaseTitle}, ""),
+		strings.Join([]string{"version:", config.ReleaseVersion}, ""),
+		strings.Join([]string{"protocol:", strconv.Itoa(protocol)}, ""),
+		strings.Join([]string{"user:", user}, ""),
+		strings.Join([]string{"address:", cmd.Connection.RemoteAddr().String()}, ""), // Of the original client, if forwarded by a trusted proxy
+		strings.Join([]string{"database:", cmd.Selected}, ""),
+		strings.Join([]string{"namespace:", cmd.Namespace}, ""),
+	}
+	if cmd.RESP != 0 { // Redis clients expect pairs of keys and values
+		cmd.Writer.Map(len(details))
+		for _, detail := range details {
+			key, value, _ := strings.Cut(detail, ":")
+			cmd.Writer.Bulk(key)
+			cmd.Writer.Bulk(value)
+		}
+	} else {
+		cmd.Writer.Array(len(details))
+		for _, detail := range details {
+			cmd.Writer.Bulk(detail)
 		}
-		return cmd.Index, true
 	}
 
-	if newIndex < 0 || newIndex >= config.MemoryCacheContainerSize {
-		responses = []string{"!1\r\n", "-ERR index value is out of bounds\r\n"}
-		if _, wErr = cmd.Connection.Write(writer.BuildResponse(responses)); wErr != nil {
-			return cmd.Index, false
+	return cmd.Selected, true
+}
+
+// aclCommand(): Manages the users. 'ACL WHOAMI' returns the user of the session, the other subcommands require administrative permissions.
+func (cmd *Command) aclCommand() (string, bool) {
+	clen := len(cmd.Arguments)
+	if clen < 2 {
+		cmd.Writer.Error("wrong number of arguments for '" + cmd.Arguments[0] + "' command")
+		return cmd.Selected, true
+	}
+
+	subcommand := strings.ToUpper(cmd.Arguments[1])
+	if !slices.Contains([]string{"WHOAMI", "LIST", "GETUSER", "SETUSER", "DELUSER"}, subcommand) {
+		cmd.Writer.Error("unknown subcommand '" + cmd.Arguments[1] + "'")
+		return cmd.Selected, true
+	}
+
+	if ((subcommand == "WHOAMI" || subcommand == "LIST") && clen != 2) ||
+		(subcommand == "GETUSER" && clen != 3) || ((subcommand == "SETUSER" || subcommand == "DELUSER") && clen < 3) {
+		cmd.Writer.Error("wrong number of arguments for '" + cmd.Arguments[0] + "' command")
+		return cmd.Selected, true
+	}
+
+	if !auth.Enabled() {
+		cmd.Writer.Error(errAuthDisabled.Error())
+		return cmd.Selected, true
+	}
+
+	switch subcommand {
+	case "WHOAMI":
+		if cmd.User == nil { // Session of the admin listener
+			cmd.Writer.Error(errNotAuthenticated.Error())
+			break
 		}
-		return cmd.Index, true
+		cmd.Writer.Bulk(cmd.User.Name)
+	case "LIST":
+		users := auth.ListUsers()
+		cmd.Writer.Array(len(users))
+		for _, user := range users {
+			cmd.Writer.Bulk(user.Describe())
+		}
+	case "GETUSER":
+		user, ok := auth.LookupUser(cmd.Arguments[2])
+		if !ok {
+			cmd.Writer.Error(errUnknownUser.Error())
+			break
+		}
+		details := user.Details()
+		cmd.Writer.Array(len(details))
+		for _, detail := range details {
+			cmd.Writer.Bulk(detail)
+		}
+	case "SETUSER":
+		if err := auth.SetUser(cmd.Arguments[2], cmd.Arguments[3:]); err != nil {
+			cmd.Writer.Error(err.Error()) // Rules are quoted in errors
+			break
+		}
+		cmd.Writer.OK()
+	case "DELUSER":
+		deleted, err := auth.DeleteUsers(cmd.Arguments[2:])
+		if err != nil {
+			cmd.Writer.Error(err.Error())
+			break
+		}
+		cmd.Writer.Int(deleted)
+	}
+	return cmd.Selected, true
+}
+
+/* multi-database commands */
+
+// selectCommand(): Select the active logical database for the current session.
+func (cmd *Command) selectCommand() (string, bool) {
+	if len(cmd.Arguments) != 2 {
+		cmd.Writer.Error("wrong number of arguments for '" + cmd.Arguments[0] + "' command")
+		return cmd.Selected, true
+	}
+
+	if err := cmd.permitDatabase(cmd.Arguments[1]); err != nil {
+		cmd.Writer.Error(err.Error())
+		return cmd.Selected, true
 	}
 
-	responses = []string{"!1\r\n", "+OK\r\n"}
-	if _, wErr = cmd.Connection.Write(writer.BuildResponse(responses)); wErr != nil {
-		return newIndex, false
+	if _, ok := memory.Container.Load(cmd.Arguments[1]); !ok {
+		cmd.Writer.Error("no such database")
+		return cmd.Selected, true
 	}
-	return newIndex, true
+
+	cmd.Writer.OK()
+	return cmd.Arguments[1], true
 }
 
-// flushallCommand(): Deletes all of the keys in every database. Requires elevated privileges.
-func (cmd *Command) flushallCommand() (int, bool) {
-	var wErr error
-	var responses []string
-	var wg sync.WaitGroup
+// namespaceCommand(): Confines the session to a namespace, prefixing its keys transparently. Without a name, the current namespace is returned.
+func (cmd *Command) namespaceCommand() (string, bool) {
+	clen := len(cmd.Arguments)
+	if clen > 2 {
+		cmd.Writer.Error("wrong number of arguments for '" + cmd.Arguments[0] + "' command")
+		return cmd.Selected, true
+	}
 
-	if len(cmd.Arguments) != 1 {
-		responses = []string{"!1\r\n", "-ERR wrong number of arguments for '", cmd.Arguments[0], "' command\r\n"}
-		if _, wErr = cmd.Connection.Write(writer.BuildResponse(responses)); wErr != nil {
-			return cmd.Index, false
+	if clen == 1 {
+		if cmd.Namespace != "" {
+			cmd.Writer.Bulk(cmd.Namespace)
+		} else if cmd.RESP != 0 {
+			cmd.Writer.Nil()
+		} else {
+			cmd.Writer.Array(0)
 		}
-		return cmd.Index, true
+		return cmd.Selected, true
 	}
 
-	address := cmd.Connection.RemoteAddr()
-	if !isAdmin(address) {
-		responses = []string{"!1\r\n", "-ERR insufficient permissions\r\n"}
-		if _, wErr = cmd.Connection.Write(writer.BuildResponse(responses)); wErr != nil {
-			return cmd.Index, false
-		}
-		return cmd.Index, true
+	if cmd.User != nil && cmd.User.Namespace() != "" {
+		cmd.Writer.Error("namespace is fixed for this user")
+		return cmd.Selected, true
 	}
 
-	wg.Add(config.MemoryCacheContainerSize)
-	for _, database := range memory.Container {
-		go func(database memory.ShardedCache) {
-			defer wg.Done()
-			database.Clear()
-		}(*database)
+	if !memory.ValidName(cmd.Arguments[1]) { // Same rules as database names, so prefixes can't contain glob patterns
+		cmd.Writer.Error("invalid namespace")
+		return cmd.Selected, true
 	}
 
-	wg.Wait()
+	cmd.Namespace = cmd.Arguments[1]
+	cmd.Writer.OK()
+	return cmd.Selected, true
+}
+
+// dbCommand(): Manages the named databases. 'DB LIST' returns their names, 'DB CREATE' and 'DB DROP' require elevated privileges.
+func (cmd *Command) dbCommand() (string, bool) {
+	clen := len(cmd.Arguments)
+	if clen < 2 {
+		cmd.Writer.Error("wrong number of arguments for '" + cmd.Arguments[0] + "' command")
+		return cmd.Selected, true
+	}
 
-	responses = []string{"!1\r\n", "+OK\r\n"}
-	if _, wErr = cmd.Connection.Write(writer.BuildResponse(responses)); wErr != nil {
-		return cmd.Index, false
+	subcommand := strings.ToUpper(cmd.Arguments[1])
+	if subcommand != "LIST" && subcommand != "CREATE" && subcommand != "DROP" {
+		cmd.Writer.Error("unknown subcommand '" + cmd.Arguments[1] + "'")
+		return cmd.Selected, true
 	}
-	return cmd.Index, true
-}
 
-// moveCommand(): Move key from the currently selected database to the specified destination database.
-func (cmd *Command) moveCommand() (int, bool) {
-	var wErr error
-	var responses []string
+	if (subcommand == "LIST" && clen != 2) || (subcommand != "LIST" && clen != 3) {
+		cmd.Writer.Error("wrong number of arguments for '" + cmd.Arguments[0] + "' command")
+		return cmd.Selected, true
+	}
 
-	if len(cmd.Arguments) != 3 {
-		responses = []string{"!1\r\n", "-ERR wrong number of arguments for '", cmd.Arguments[0], "' command\r\n"}
-		if _, wErr = cmd.Connection.Write(writer.BuildResponse(responses)); wErr != nil {
-			return cmd.Index, false
+	if subcommand == "LIST" {
+		names := memory.Container.Names()
+		cmd.Writer.Array(len(names))
+		for _, name := range names {
+			cmd.Writer.Bulk(name)
 		}
-		return cmd.Index, true
+		return cmd.Selected, true
+	}
+
+	if !cmd.privileged() {
+		cmd.Writer.Error("insufficient permissions")
+		return cmd.Selected, true
 	}
 
-	newIndex, err := strconv.Atoi(cmd.Arguments[2])
+	var err error
+	if subcommand == "CREATE" {
+		_, err = memory.Container.Create(cmd.Arguments[2])
+	} else if err = memory.Container.Drop(cmd.Arguments[2]); err == nil {
+		err = storage.RemoveLabel(cmd.Arguments[2]) // Otherwise the database would be restored on the next start
+	}
 	if err != nil {
-		responses = []string{"!1\r\n", "-ERR index value is not an integer\r\n"}
-		if _, wErr = cmd.Connection.Write(writer.BuildResponse(responses)); wErr != nil {
-			return cmd.Index, false
-		}
-		return cmd.Index, true
+		cmd.Writer.Error(err.Error())
+		return cmd.Selected, true
 	}
 
-	if newIndex < 0 || newIndex >= config.MemoryCacheContainerSize {
-		responses = []string{"!1\r\n", "-ERR index value is out of bounds\r\n"}
-		if _, wErr = cmd.Connection.Write(writer.BuildResponse(responses)); wErr != nil {
-			return cmd.Index, false
-		}
-		return cmd.Index, true
+	cmd.Writer.OK()
+	return cmd.Selected, true
+}
+
+// flushallCommand(): Deletes all of the keys in every database. Requires elevated privileges.
+func (cmd *Command) flushallCommand() (string, bool) {
+	if len(cmd.Arguments) != 1 {
+		cmd.Writer.Error("wrong number of arguments for '" + cmd.Arguments[0] + "' command")
+		return cmd.Selected, true
 	}
 
-	if newIndex == cmd.Index {
-		responses = []string{"!1\r\n", "+OK\r\n"}
-		if _, wErr = cmd.Connection.Write(writer.BuildResponse(responses)); wErr != nil {
-			return cmd.Index, false
-		}
-		return cmd.Index, true
+	if !cmd.privileged() {
+		cmd.Writer.Error("insufficient permissions")
+		return cmd.Selected, true
+	}
+
+	memory.Container.ClearAll()
+
+	cmd.Writer.OK()
+	return cmd.Selected, true
+}
+
+// moveCommand(): Move key from the currently selected database to the specified destination database.
+func (cmd *Command) moveCommand() (string, bool) {
+	if len(cmd.Arguments) != 3 {
+		cmd.Writer.Error("wrong number of arguments for '" + cmd.Arguments[0] + "' command")
+		return cmd.Selected, true
 	}
 
-	newDatabase := memory.Container[newIndex]
+	if cmd.Arguments[2] == cmd.Selected {
+		cmd.Writer.OK()
+		return cmd.Selected, true
+	}
+
+	if err := cmd.permitDatabase(cmd.Arguments[2]); err != nil {
+		cmd.Writer.Error(err.Error())
+		return cmd.Selected, true
+	}
+
+	newDatabase, ok := memory.Container.Load(cmd.Arguments[2])
+	if !ok {
+		cmd.Writer.Error("no such database")
+		return cmd.Selected, true
+	}
 
 	// New key and db = new shard, hence the separate ops
 	if value, ok := cmd.Database.Load(cmd.Arguments[1]); ok {
 		if _, ok := newDatabase.LoadExistStore(cmd.Arguments[1], value, false, false); ok {
-			responses = []string{"!1\r\n", "-ERR key already exists in destination database\r\n"}
-			if _, wErr = cmd.Connection.Write(writer.BuildResponse(responses)); wErr != nil {
-				return cmd.Index, false
-			}
-			return cmd.Index, true
+			cmd.Writer.Error("key already exists in destination database")
+			return cmd.Selected, true
 		}
 		cmd.Database.Delete(cmd.Arguments[1]) // And we'll only delete the key if it's movable
-		responses = []string{"!1\r\n", "+OK\r\n"}
-		if _, wErr = cmd.Connection.Write(writer.BuildResponse(responses)); wErr != nil {
-			return cmd.Index, false
-		}
+		cmd.Writer.OK()
 	} else {
-		responses = []string{"!1\r\n", "-ERR no such key\r\n"}
-		if _, wErr = cmd.Connection.Write(writer.BuildResponse(responses)); wErr != nil {
-			return cmd.Index, false
+		cmd.Writer.Error("no such key")
+	}
+	return cmd.Selected, true
+}
+
+// swapdbCommand(): Atomically swaps two databases, so that clients immediately see the data of the other database. Requires elevated privileges.
+func (cmd *Command) swapdbCommand() (string, bool) {
+	if len(cmd.Arguments) != 3 {
+		cmd.Writer.Error("wrong number of arguments for '" + cmd.Arguments[0] + "' command")
+		return cmd.Selected, true
+	}
+
+	if !cmd.privileged() {
+		cmd.Writer.Error("insufficient permissions")
+		return cmd.Selected, true
+	}
+
+	for _, name := range cmd.Arguments[1:] {
+		if err := cmd.permitDatabase(name); err != nil {
+			cmd.Writer.Error(err.Error())
+			return cmd.Selected, true
 		}
 	}
-	return cmd.Index, true
+
+	if err := memory.Container.Swap(cmd.Arguments[1], cmd.Arguments[2]); err != nil {
+		cmd.Writer.Error(err.Error())
+		return cmd.Selected, true
+	}
+
+	cmd.Writer.OK()
+	return cmd.Selected, true
 }
 
-/* single-database commands */
+// dbsizeCommand(): Returns the number of keys in the currently selected database.
+func (cmd *Command) dbsizeCommand() (string, bool) {
+	if len(cmd.Arguments) != 1 {
+		cmd.Writer.Error("wrong number of arguments for '" + cmd.Arguments[0] + "' command")
+		return cmd.Selected, true
+	}
+
+	totalKeys, _ := cmd.Database.Count()
+	cmd.Writer.Int(totalKeys)
+	return cmd.Selected, true
+}
 
-// mgetCommand(): Returns the values of all specified keys. If the key does not exist, an empty value is returned.
-func (cmd *Command) mgetCommand() (int, bool) {
-	var wErr error
+/* single-database commands */
 
+// mgetCommand(): Returns the values of all specified keys. If the key does not exist, nil is returned.
+func (cmd *Command) mgetCommand() (string, bool) {
 	clen := len(cmd.Arguments[1:])
 	if clen < 1 {
-		responses := []string{"!1\r\n", "-ERR wrong number of arguments for '", cmd.Arguments[0], "' command\r\n"}
-		if _, wErr = cmd.Connection.Write(writer.BuildResponse(responses)); wErr != nil {
-			return cmd.Index, false
-		}
-		return cmd.Index, true
+		cmd.Writer.Error("wrong number of arguments for '" + cmd.Arguments[0] + "' command")
+		return cmd.Selected, true
 	}
 
-	maxSize := clen*2 + 3 // INFO: Maximum possible size (clen * 2 ['value' + '\r\n', or just '\r\n'] + 3 protocol)
-	var responses = make([]string, 0, maxSize)
-	responses = append(responses, "!", strconv.Itoa(clen), "\r\n")
+	cmd.Writer.Array(clen)
 	for i := 1; i <= clen; i++ {
 		value, ok := cmd.Database.Load(cmd.Arguments[i])
 		if ok {
-			responses = append(responses, value, "\r\n")
+			cmd.Writer.Bulk(value)
 		} else {
-			responses = append(responses, "\r\n")
+			cmd.Writer.Nil()
 		}
 	}
 
-	if _, wErr = cmd.Connection.Write(writer.BuildResponse(responses)); wErr != nil {
-		return cmd.Index, false
-	}
-	return cmd.Index, true
+	return cmd.Selected, true
 }
 
 // msetCommand(): Sets the given keys to their respective values, replacing existing values.
-func (cmd *Command) msetCommand() (int, bool) {
-	var wErr error
-	var responses []string
-
+func (cmd *Command) msetCommand() (string, bool) {
 	clen := len(cmd.Arguments[1:])
 	if clen%2 != 0 || clen == 0 {
-		responses = []string{"!1\r\n", "-ERR wrong number of arguments for '", cmd.Arguments[0], "' command\r\n"}
-		if _, wErr = cmd.Connection.Write(writer.BuildResponse(responses)); wErr != nil {
-			return cmd.Index, false
-		}
-		return cmd.Index, true
+		cmd.Writer.Error("wrong number of arguments for '" + cmd.Arguments[0] + "' command")
+		return cmd.Selected, true
 	}
 
 	for i := 2; i <= clen; i += 2 {
 		cmd.Database.Store(cmd.Arguments[i-1], cmd.Arguments[i])
 	}
 
-	responses = []string{"!1\r\n", "+OK\r\n"}
-	if _, wErr = cmd.Connection.Write(writer.BuildResponse(responses)); wErr != nil {
-		return cmd.Index, false
-	}
-	return cmd.Index, true
+	cmd.Writer.OK()
+	return cmd.Selected, true
 }
 
-// getCommand(): Retrieves the value of a key if it exists.
-func (cmd *Command) getCommand() (int, bool) {
-	var wErr error
-	var responses []string
-
+// getCommand(): Retrieves the value of a key if it exists, nil otherwise.
+func (cmd *Command) getCommand() (string, bool) {
 	if len(cmd.Arguments) != 2 {
-		responses = []string{"!1\r\n", "-ERR wrong number of arguments for '", cmd.Arguments[0], "' command\r\n"}
-		if _, wErr = cmd.Connection.Write(writer.BuildResponse(responses)); wErr != nil {
-			return cmd.Index, false
-		}
-		return cmd.Index, true
+		cmd.Writer.Error("wrong number of arguments for '" + cmd.Arguments[0] + "' command")
+		return cmd.Selected, true
 	}
 
 	value, ok := cmd.Database.Load(cmd.Arguments[1])
 	if ok {
-		responses = []string{"!1\r\n", value, "\r\n"}
-		_, wErr = cmd.Connection.Write(writer.BuildResponse(responses))
+		cmd.Writer.Bulk(value)
 	} else {
-		responses = []string{"!1\r\n", "\r\n"}
-		_, wErr = cmd.Connection.Write(writer.BuildResponse(responses))
+		cmd.Writer.Nil()
 	}
-	if wErr != nil {
-		return cmd.Index, false
-	}
-	return cmd.Index, true
+	return cmd.Selected, true
 }
 
 // setCommand(): Stores a key value pair. Optionally sets expiration on the key.
-func (cmd *Command) setCommand() (int, bool) {
+func (cmd *Command) setCommand() (string, bool) {
 	syntaxError, checkExist, checkExpire := false, false, false
 	var optExist, optExpire, durExpire string
-	var wErr error
-	var responses []string
 
 	clen := len(cmd.Arguments)
 	if clen < 3 || clen > 6 {
-		responses = []string{"!1\r\n", "-ERR wrong number of arguments for '", cmd.Arguments[0], "' command\r\n"}
-		if _, wErr = cmd.Connection.Write(writer.BuildResponse(responses)); wErr != nil {
-			return cmd.Index, false
-		}
-		return cmd.Index, true
+		cmd.Writer.Error("wrong number of arguments for '" + cmd.Arguments[0] + "' command")
+		return cmd.Selected, true
 	}
 
 	// Parse
@@ -355,10 +707,7 @@ func (cmd *Command) setCommand() (int, bool) {
 	// Run
 	var exists bool
 	if syntaxError {
-		responses = []string{"!1\r\n", "-ERR wrong syntax for '", cmd.Arguments[0], "' command\r\n"}
-		if _, wErr = cmd.Connection.Write(writer.BuildResponse(responses)); wErr != nil {
-			return cmd.Index, false
-		}
+		cmd.Writer.Error("wrong syntax for '" + cmd.Arguments[0] + "' command")
 	} else {
 		if checkExist {
 			if optExist == "XX" {
@@ -368,21 +717,13 @@ func (cmd *Command) setCommand() (int, bool) {
 			}
 
 			if _, ok := cmd.Database.LoadExistStore(cmd.Arguments[1], cmd.Arguments[2], exists, false); ok == exists {
-				responses = []string{"!1\r\n", "+OK\r\n"}
-				_, wErr = cmd.Connection.Write(writer.BuildResponse(responses))
+				cmd.Writer.OK()
 			} else {
-				responses = []string{"!1\r\n", "\r\n"}
-				_, wErr = cmd.Connection.Write(writer.BuildResponse(responses))
-			}
-			if wErr != nil {
-				return cmd.Index, false
+				cmd.Writer.Nil()
 			}
 		} else {
 			cmd.Database.Store(cmd.Arguments[1], cmd.Arguments[2])
-			responses = []string{"!1\r\n", "+OK\r\n"}
-			if _, wErr = cmd.Connection.Write(writer.BuildResponse(responses)); wErr != nil {
-				return cmd.Index, false
-			}
+			cmd.Writer.OK()
 		}
 
 		if checkExpire {
@@ -390,148 +731,174 @@ func (cmd *Command) setCommand() (int, bool) {
 		}
 	}
 
-	return cmd.Index, true
+	return cmd.Selected, true
 }
 
-// incrCommand(): Increments the integer value stored at key by the increment, creating it prior if it doesn't exist.
-func (cmd *Command) incrCommand() (int, bool) {
-	var wErr error
-	var responses []string
-
+// incrCommand(): Increments the integer value stored at key by the increment, creating it prior if it doesn't exist. Optionally bounded.
+func (cmd *Command) incrCommand() (string, bool) {
 	clen := len(cmd.Arguments)
-	if clen < 2 || clen > 3 {
-		responses = []string{"!1\r\n", "-ERR wrong number of arguments for '", cmd.Arguments[0], "' command\r\n"}
-		if _, wErr = cmd.Connection.Write(writer.BuildResponse(responses)); wErr != nil {
-			return cmd.Index, false
-		}
-		return cmd.Index, true
+	if clen < 2 {
+		cmd.Writer.Error("wrong number of arguments for '" + cmd.Arguments[0] + "' command")
+		return cmd.Selected, true
 	}
 
 	var err error
 	increment := 1
-	if clen == 3 {
+	options := cmd.Arguments[2:]
+	if clen > 2 && !isCounterOption(cmd.Arguments[2]) {
 		increment, err = strconv.Atoi(cmd.Arguments[2])
 		if err != nil {
-			responses = []string{"!1\r\n", "-ERR increment is either not an integer or too large\r\n"}
-			if _, wErr = cmd.Connection.Write(writer.BuildResponse(responses)); wErr != nil {
-				return cmd.Index, false
-			}
-			return cmd.Index, true
+			cmd.Writer.Error("increment is either not an integer or too large")
+			return cmd.Selected, true
 		}
 		if increment < 1 {
-			responses = []string{"!1\r\n", "-ERR inverse/non operations are discouraged\r\n"}
-			if _, wErr = cmd.Connection.Write(writer.BuildResponse(responses)); wErr != nil {
-				return cmd.Index, false
-			}
-			return cmd.Index, true
+			cmd.Writer.Error("inverse/non operations are discouraged")
+			return cmd.Selected, true
+		}
+		options = cmd.Arguments[3:]
+	}
+
+	return cmd.counterCommand(increment, options)
+}
+
+// decrCommand(): Decrements the integer value stored at key by the decrement, creating it prior if it doesn't exist. Optionally bounded.
+func (cmd *Command) decrCommand() (string, bool) {
+	clen := len(cmd.Arguments)
+	if clen < 2 {
+		cmd.Writer.Error("wrong number of arguments for '" + cmd.Arguments[0] + "' command")
+		return cmd.Selected, true
+	}
+
+	var err error
+	decrement := 1
+	options := cmd.Arguments[2:]
+	if clen > 2 && !isCounterOption(cmd.Arguments[2]) {
+		decrement, err = strconv.Atoi(cmd.Arguments[2])
+		if err != nil {
+			cmd.Writer.Error("decrement is either not an integer or too large")
+			return cmd.Selected, true
+		}
+		if decrement < 1 {
+			cmd.Writer.Error("inverse/non operations are discouraged")
+			return cmd.Selected, true
 		}
+		options = cmd.Arguments[3:]
+	}
+
+	return cmd.counterCommand(-decrement, options)
+}
+
+// incrbyCommand(): Adds the signed increment to the integer value stored at key, creating it prior if it doesn't exist. Optionally bounded.
+func (cmd *Command) incrbyCommand() (string, bool) {
+	if len(cmd.Arguments) < 3 {
+		cmd.Writer.Error("wrong number of arguments for '" + cmd.Arguments[0] + "' command")
+		return cmd.Selected, true
+	}
+
+	increment, err := strconv.Atoi(cmd.Arguments[2])
+	if err != nil {
+		cmd.Writer.Error("increment is either not an integer or too large")
+		return cmd.Selected, true
 	}
 
+	return cmd.counterCommand(increment, cmd.Arguments[3:])
+}
+
+// decrbyCommand(): Subtracts the signed decrement from the integer value stored at key, creating it prior if it doesn't exist. Optionally bounded.
+func (cmd *Command) decrbyCommand() (string, bool) {
+	if len(cmd.Arguments) < 3 {
+		cmd.Writer.Error("wrong number of arguments for '" + cmd.Arguments[0] + "' command")
+		return cmd.Selected, true
+	}
+
+	decrement, err := strconv.Atoi(cmd.Arguments[2])
+	if err != nil || decrement == math.MinInt { // The minimum can't be negated
+		cmd.Writer.Error("decrement is either not an integer or too large")
+		return cmd.Selected, true
+	}
+
+	return cmd.counterCommand(-decrement, cmd.Arguments[3:])
+}
+
+// counterCommand(): Applies the delta to the integer value stored at key, respecting the bounds given by the options.
+func (cmd *Command) counterCommand(delta int, options []string) (string, bool) {
+	bounds, err := parseCounterOptions(options)
+	if err != nil {
+		cmd.Writer.Error(err.Error())
+		return cmd.Selected, true
+	}
+
+	var counterErr error
+	var counter int
 	value, status := cmd.Database.LoadModifyStore(
 		cmd.Arguments[1],
 		func(v string) (string, bool) {
-			n, err := strconv.Atoi(v)
+			n, err := applyDelta(v, delta, bounds)
 			if err != nil {
+				counterErr = err
 				return v, false
 			}
-			positive := n > 0
-			n += increment
-			if positive && n < 0 {
-				return v, false
-			}
+			counter = n
 			return strconv.Itoa(n), true
 		},
 		"0",
 	)
 
 	if !status {
-		responses = []string{"!1\r\n", "-ERR value is either not an integer or too large\r\n"}
-		_, wErr = cmd.Connection.Write(writer.BuildResponse(responses))
+		cmd.Writer.Error(counterErr.Error())
+	} else if cmd.RESP != 0 { // Redis clients expect an integer
+		cmd.Writer.Int(counter)
 	} else {
-		responses = []string{"!1\r\n", value, "\r\n"}
-		_, wErr = cmd.Connection.Write(writer.BuildResponse(responses))
-	}
-	if wErr != nil {
-		return cmd.Index, false
+		cmd.Writer.Bulk(value)
 	}
-	return cmd.Index, true
+	return cmd.Selected, true
 }
 
-// decrCommand(): Decrements the integer value stored at key by the decrement, creating it prior if it doesn't exist.
-func (cmd *Command) decrCommand() (int, bool) {
-	var wErr error
-	var responses []string
-
-	clen := len(cmd.Arguments)
-	if clen < 2 || clen > 3 {
-		responses = []string{"!1\r\n", "-ERR wrong number of arguments for '", cmd.Arguments[0], "' command\r\n"}
-		if _, wErr = cmd.Connection.Write(writer.BuildResponse(responses)); wErr != nil {
-			return cmd.Index, false
-		}
-		return cmd.Index, true
+// incrbyfloatCommand(): Increments the floating point value stored at key by the increment, creating it prior if it doesn't exist.
+func (cmd *Command) incrbyfloatCommand() (string, bool) {
+	if len(cmd.Arguments) != 3 {
+		cmd.Writer.Error("wrong number of arguments for '" + cmd.Arguments[0] + "' command")
+		return cmd.Selected, true
 	}
 
-	var err error
-	decrement := 1
-	if clen == 3 {
-		decrement, err = strconv.Atoi(cmd.Arguments[2])
-		if err != nil {
-			responses = []string{"!1\r\n", "-ERR decrement is either not an integer or too large\r\n"}
-			if _, wErr = cmd.Connection.Write(writer.BuildResponse(responses)); wErr != nil {
-				return cmd.Index, false
-			}
-			return cmd.Index, true
-		}
-		if decrement < 1 {
-			responses = []string{"!1\r\n", "-ERR inverse/non operations are discouraged\r\n"}
-			if _, wErr = cmd.Connection.Write(writer.BuildResponse(responses)); wErr != nil {
-				return cmd.Index, false
-			}
-			return cmd.Index, true
-		}
+	increment, err := strconv.ParseFloat(cmd.Arguments[2], 64)
+	if err != nil || math.IsNaN(increment) || math.IsInf(increment, 0) {
+		cmd.Writer.Error("increment is not a valid float")
+		return cmd.Selected, true
 	}
 
+	var floatErr error
 	value, status := cmd.Database.LoadModifyStore(
 		cmd.Arguments[1],
 		func(v string) (string, bool) {
-			n, err := strconv.Atoi(v)
-			if err != nil {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+				floatErr = errNotFloat
 				return v, false
 			}
-			negative := n < 0
-			n -= decrement
-			if negative && n > 0 {
+			f += increment
+			if math.IsNaN(f) || math.IsInf(f, 0) {
+				floatErr = errFloatRange
 				return v, false
 			}
-			return strconv.Itoa(n), true
+			return strconv.FormatFloat(f, 'f', -1, 64), true
 		},
 		"0",
 	)
 
 	if !status {
-		responses = []string{"!1\r\n", "-ERR value is either not an integer or too large\r\n"}
-		_, wErr = cmd.Connection.Write(writer.BuildResponse(responses))
+		cmd.Writer.Error(floatErr.Error())
 	} else {
-		responses = []string{"!1\r\n", value, "\r\n"}
-		_, wErr = cmd.Connection.Write(writer.BuildResponse(responses))
-	}
-	if wErr != nil {
-		return cmd.Index, false
+		cmd.Writer.Bulk(value)
 	}
-	return cmd.Index, true
+	return cmd.Selected, true
 }
 
 // appendCommand(): Appends to the value stored at key, creating it prior if it doesn't exist.
-func (cmd *Command) appendCommand() (int, bool) {
-	var wErr error
-	var responses []string
-
+func (cmd *Command) appendCommand() (string, bool) {
 	if len(cmd.Arguments) != 3 {
-		responses = []string{"!1\r\n", "-ERR wrong number of arguments for '", cmd.Arguments[0], "' command\r\n"}
-		if _, wErr = cmd.Connection.Write(writer.BuildResponse(responses)); wErr != nil {
-			return cmd.Index, false
-		}
-		return cmd.Index, true
+		cmd.Writer.Error("wrong number of arguments for '" + cmd.Arguments[0] + "' command")
+		return cmd.Selected, true
 	}
 
 	value, _ := cmd.Database.LoadModifyStore(
@@ -542,24 +909,15 @@ func (cmd *Command) appendCommand() (int, bool) {
 		"",
 	)
 
-	responses = []string{"!1\r\n", value, "\r\n"}
-	if _, wErr = cmd.Connection.Write(writer.BuildResponse(responses)); wErr != nil {
-		return cmd.Index, false
-	}
-	return cmd.Index, true
+	cmd.Writer.Bulk(value)
+	return cmd.Selected, true
 }
 
 // prependCommand(): Prepends to the value stored at key, creating it prior if it doesn't exist.
-func (cmd *Command) prependCommand() (int, bool) {
-	var wErr error
-	var responses []string
-
+func (cmd *Command) prependCommand() (string, bool) {
 	if len(cmd.Arguments) != 3 {
-		responses = []string{"!1\r\n", "-ERR wrong number of arguments for '", cmd.Arguments[0], "' command\r\n"}
-		if _, wErr = cmd.Connection.Write(writer.BuildResponse(responses)); wErr != nil {
-			return cmd.Index, false
-		}
-		return cmd.Index, true
+		cmd.Writer.Error("wrong number of arguments for '" + cmd.Arguments[0] + "' command")
+		return cmd.Selected, true
 	}
 
 	value, _ := cmd.Database.LoadModifyStore(
@@ -570,83 +928,128 @@ func (cmd *Command) prependCommand() (int, bool) {
 		"",
 	)
 
-	responses = []string{"!1\r\n", value, "\r\n"}
-	if _, wErr = cmd.Connection.Write(writer.BuildResponse(responses)); wErr != nil {
-		return cmd.Index, false
-	}
-	return cmd.Index, true
+	cmd.Writer.Bulk(value)
+	return cmd.Selected, true
 }
 
 // lenCommand(): Returns the value length of all the specified keys.
-func (cmd *Command) lenCommand() (int, bool) {
-	var wErr error
-
+func (cmd *Command) lenCommand() (string, bool) {
 	clen := len(cmd.Arguments[1:])
 	if clen < 1 {
-		responses := []string{"!1\r\n", "-ERR wrong number of arguments for '", cmd.Arguments[0], "' command\r\n"}
-		if _, wErr = cmd.Connection.Write(writer.BuildResponse(responses)); wErr != nil {
-			return cmd.Index, false
-		}
-		return cmd.Index, true
+		cmd.Writer.Error("wrong number of arguments for '" + cmd.Arguments[0] + "' command")
+		return cmd.Selected, true
 	}
 
-	maxSize := clen*3 + 3
-	var responses = make([]string, 0, maxSize)
-	responses = append(responses, "!", strconv.Itoa(clen), "\r\n")
+	cmd.Writer.Array(clen)
 	for _, k := range cmd.Arguments[1:] {
-		if v, ok := cmd.Database.Load(k); ok {
-			responses = append(responses, "$", strconv.Itoa(len(v)), "\r\n")
+		if v, ok := cmd.Database.Load(k); !ok {
+			cmd.Writer.Nil()
+		} else if cmd.RESP != 0 || cmd.Protocol >= 2 { // Typed integers, unless protocol 1 clients expect the '$<length>' line
+			cmd.Writer.Int(len(v))
 		} else {
-			responses = append(responses, "$-1\r\n")
+			cmd.Writer.Bulk("$" + strconv.Itoa(len(v)))
 		}
 	}
 
-	if _, wErr = cmd.Connection.Write(writer.BuildResponse(responses)); wErr != nil {
-		return cmd.Index, false
+	return cmd.Selected, true
+}
+
+// strlenCommand(): Returns the length of the value stored at key, or zero if the key doesn't exist.
+func (cmd *Command) strlenCommand() (string, bool) {
+	if len(cmd.Arguments) != 2 {
+		cmd.Writer.Error("wrong number of arguments for '" + cmd.Arguments[0] + "' command")
+		return cmd.Selected, true
 	}
-	return cmd.Index, true
+
+	value, _ := cmd.Database.Load(cmd.Arguments[1])
+	cmd.Writer.Int(len(value))
+	return cmd.Selected, true
 }
 
-// renameCommand(): Renames key to newkey, returning an error if key doesn't exist and overwriting newkey if it exists.
-func (cmd *Command) renameCommand() (int, bool) {
-	var wErr error
-	var responses []string
+// getrangeCommand(): Returns the substring of the value stored at key, determined by the inclusive offsets start and end.
+func (cmd *Command) getrangeCommand() (string, bool) {
+	if len(cmd.Arguments) != 4 {
+		cmd.Writer.Error("wrong number of arguments for '" + cmd.Arguments[0] + "' command")
+		return cmd.Selected, true
+	}
+
+	start, sErr := strconv.Atoi(cmd.Arguments[2])
+	end, eErr := strconv.Atoi(cmd.Arguments[3])
+	if sErr != nil || eErr != nil {
+		cmd.Writer.Error("value is not an integer or out of range")
+		return cmd.Selected, true
+	}
 
+	value, _ := cmd.Database.Load(cmd.Arguments[1])
+	if start, end, ok := normalizeRange(start, end, len(value)); ok {
+		cmd.Writer.Bulk(value[start : end+1])
+	} else {
+		cmd.Writer.Bulk("")
+	}
+	return cmd.Selected, true
+}
+
+// setrangeCommand(): Overwrites part of the value stored at key starting at offset, zero-padding the value if needed. Returns the new length.
+func (cmd *Command) setrangeCommand() (string, bool) {
+	if len(cmd.Arguments) != 4 {
+		cmd.Writer.Error("wrong number of arguments for '" + cmd.Arguments[0] + "' command")
+		return cmd.Selected, true
+	}
+
+	patch := cmd.Arguments[3]
+	offset, err := strconv.Atoi(cmd.Arguments[2])
+	if err != nil || offset < 0 || offset > bitOffsetLimit/8-len(patch) { // Can't overflow, unlike offset+len(patch)
+		cmd.Writer.Error("offset is not an integer or out of range")
+		return cmd.Selected, true
+	}
+
+	var length int
+	if patch == "" { // Nothing to write, so we won't create the key either
+		value, _ := cmd.Database.Load(cmd.Arguments[1])
+		length = len(value)
+	} else {
+		value, _ := cmd.Database.LoadModifyStore(
+			cmd.Arguments[1],
+			func(v string) (string, bool) {
+				buf := []byte(v)
+				if end := offset + len(patch); end > len(buf) {
+					buf = append(buf, make([]byte, end-len(buf))...)
+				}
+				copy(buf[offset:], patch)
+				return string(buf), true
+			},
+			"",
+		)
+		length = len(value)
+	}
+
+	cmd.Writer.Int(length)
+	return cmd.Selected, true
+}
+
+// renameCommand(): Renames key to newkey, returning an error if key doesn't exist and overwriting newkey if it exists.
+func (cmd *Command) renameCommand() (string, bool) {
 	if len(cmd.Arguments) != 3 {
-		responses = []string{"!1\r\n", "-ERR wrong number of arguments for '", cmd.Arguments[0], "' command\r\n"}
-		if _, wErr = cmd.Connection.Write(writer.BuildResponse(responses)); wErr != nil {
-			return cmd.Index, false
-		}
-		return cmd.Index, true
+		cmd.Writer.Error("wrong number of arguments for '" + cmd.Arguments[0] + "' command")
+		return cmd.Selected, true
 	}
 
 	// New key = new shard, hence the separate load and store ops
 	if value, ok := cmd.Database.LoadAndDelete(cmd.Arguments[1]); ok {
 		cmd.Database.Store(cmd.Arguments[2], value)
-		responses = []string{"!1\r\n", "+OK\r\n"}
-		_, wErr = cmd.Connection.Write(writer.BuildResponse(responses))
+		cmd.Writer.OK()
 	} else {
-		responses = []string{"!1\r\n", "-ERR no such key\r\n"}
-		_, wErr = cmd.Connection.Write(writer.BuildResponse(responses))
+		cmd.Writer.Error("no such key")
 	}
-	if wErr != nil {
-		return cmd.Index, false
-	}
-	return cmd.Index, true
+	return cmd.Selected, true
 }
 
 // copyCommand(): Copies the value stored at the source key to the destination key, replacing the existing value if desired.
-func (cmd *Command) copyCommand() (int, bool) {
-	var wErr error
-	var responses []string
-
+func (cmd *Command) copyCommand() (string, bool) {
 	clen := len(cmd.Arguments)
 	if clen < 3 || clen > 4 {
-		responses = []string{"!1\r\n", "-ERR wrong number of arguments for '", cmd.Arguments[0], "' command\r\n"}
-		if _, wErr = cmd.Connection.Write(writer.BuildResponse(responses)); wErr != nil {
-			return cmd.Index, false
-		}
-		return cmd.Index, true
+		cmd.Writer.Error("wrong number of arguments for '" + cmd.Arguments[0] + "' command")
+		return cmd.Selected, true
 	}
 
 	exists := false
@@ -654,11 +1057,8 @@ func (cmd *Command) copyCommand() (int, bool) {
 	replace := "REPLACE"
 	if clen == 4 {
 		if strings.ToUpper(cmd.Arguments[3]) != replace {
-			responses = []string{"!1\r\n", "-ERR unknown option\r\n"}
-			if _, wErr = cmd.Connection.Write(writer.BuildResponse(responses)); wErr != nil {
-				return cmd.Index, false
-			}
-			return cmd.Index, true
+			cmd.Writer.Error("unknown option")
+			return cmd.Selected, true
 		}
 		overwrite = true
 	}
@@ -667,81 +1067,53 @@ func (cmd *Command) copyCommand() (int, bool) {
 	if value, ok := cmd.Database.Load(cmd.Arguments[1]); ok {
 		_, ok = cmd.Database.LoadExistStore(cmd.Arguments[2], value, exists, overwrite)
 		if ok == exists || overwrite {
-			responses = []string{"!1\r\n", "+OK\r\n"}
-			_, wErr = cmd.Connection.Write(writer.BuildResponse(responses))
+			cmd.Writer.OK()
 		} else {
-			responses = []string{"!1\r\n", "-ERR destination key is not empty\r\n"}
-			_, wErr = cmd.Connection.Write(writer.BuildResponse(responses))
+			cmd.Writer.Error("destination key is not empty")
 		}
 	} else {
-		responses = []string{"!1\r\n", "-ERR no such key\r\n"}
-		_, wErr = cmd.Connection.Write(writer.BuildResponse(responses))
+		cmd.Writer.Error("no such key")
 	}
-	if wErr != nil {
-		return cmd.Index, false
-	}
-	return cmd.Index, true
+	return cmd.Selected, true
 }
 
-// getsetCommand(): Atomically sets the key to the new value and returns the old value.
-func (cmd *Command) getsetCommand() (int, bool) {
-	var wErr error
-	var responses []string
-
+// getsetCommand(): Atomically sets the key to the new value and returns the old value, nil if the key didn't exist.
+func (cmd *Command) getsetCommand() (string, bool) {
 	if len(cmd.Arguments) != 3 {
-		responses = []string{"!1\r\n", "-ERR wrong number of arguments for '", cmd.Arguments[0], "' command\r\n"}
-		if _, wErr = cmd.Connection.Write(writer.BuildResponse(responses)); wErr != nil {
-			return cmd.Index, false
-		}
-		return cmd.Index, true
+		cmd.Writer.Error("wrong number of arguments for '" + cmd.Arguments[0] + "' command")
+		return cmd.Selected, true
 	}
 
-	value, _ := cmd.Database.LoadExistStore(cmd.Arguments[1], cmd.Arguments[2], true, true)
-	responses = []string{"!1\r\n", value, "\r\n"}
-	if _, wErr = cmd.Connection.Write(writer.BuildResponse(responses)); wErr != nil {
-		return cmd.Index, false
+	value, ok := cmd.Database.LoadExistStore(cmd.Arguments[1], cmd.Arguments[2], true, true)
+	if ok {
+		cmd.Writer.Bulk(value)
+	} else {
+		cmd.Writer.Nil()
 	}
-	return cmd.Index, true
+	return cmd.Selected, true
 }
 
 // getdelCommand(): Retrieves the value of a key if it exists and deletes the key.
-func (cmd *Command) getdelCommand() (int, bool) {
-	var wErr error
-	var responses []string
-
+func (cmd *Command) getdelCommand() (string, bool) {
 	if len(cmd.Arguments) != 2 {
-		responses = []string{"!1\r\n", "-ERR wrong number of arguments for '", cmd.Arguments[0], "' command\r\n"}
-		if _, wErr = cmd.Connection.Write(writer.BuildResponse(responses)); wErr != nil {
-			return cmd.Index, false
-		}
-		return cmd.Index, true
+		cmd.Writer.Error("wrong number of arguments for '" + cmd.Arguments[0] + "' command")
+		return cmd.Selected, true
 	}
 
 	value, ok := cmd.Database.LoadAndDelete(cmd.Arguments[1])
 	if ok {
-		responses = []string{"!1\r\n", value, "\r\n"}
-		_, wErr = cmd.Connection.Write(writer.BuildResponse(responses))
+		cmd.Writer.Bulk(value)
 	} else {
-		responses = []string{"!1\r\n", "\r\n"}
-		_, wErr = cmd.Connection.Write(writer.BuildResponse(responses))
-	}
-	if wErr != nil {
-		return cmd.Index, false
+		cmd.Writer.Nil()
 	}
-	return cmd.Index, true
+	return cmd.Selected, true
 }
 
 // delCommand(): Removes the specified keys. A key is ignored if it does not exist.
-func (cmd *Command) delCommand() (int, bool) {
-	var wErr error
-	var responses []string
-
+func (cmd *Command) delCommand() (string, bool) {
 	if len(cmd.Arguments) < 2 {
-		responses = []string{"!1\r\n", "-ERR wrong number of arguments for '", cmd.Arguments[0], "' command\r\n"}
-		if _, wErr = cmd.Connection.Write(writer.BuildResponse(responses)); wErr != nil {
-			return cmd.Index, false
-		}
-		return cmd.Index, true
+		cmd.Writer.Error("wrong number of arguments for '" + cmd.Arguments[0] + "' command")
+		return cmd.Selected, true
 	}
 
 	count := 0
@@ -751,24 +1123,15 @@ func (cmd *Command) delCommand() (int, bool) {
 		}
 	}
 
-	responses = []string{"!1\r\n", ":", strconv.Itoa(count), "\r\n"}
-	if _, wErr = cmd.Connection.Write(writer.BuildResponse(responses)); wErr != nil {
-		return cmd.Index, false
-	}
-	return cmd.Index, true
+	cmd.Writer.Int(count)
+	return cmd.Selected, true
 }
 
 // existsCommand(): Checks if a key exists.
-func (cmd *Command) existsCommand() (int, bool) {
-	var wErr error
-	var responses []string
-
+func (cmd *Command) existsCommand() (string, bool) {
 	if len(cmd.Arguments) < 2 {
-		responses = []string{"!1\r\n", "-ERR wrong number of arguments for '", cmd.Arguments[0], "' command\r\n"}
-		if _, wErr = cmd.Connection.Write(writer.BuildResponse(responses)); wErr != nil {
-			return cmd.Index, false
-		}
-		return cmd.Index, true
+		cmd.Writer.Error("wrong number of arguments for '" + cmd.Arguments[0] + "' command")
+		return cmd.Selected, true
 	}
 
 	count := 0
@@ -778,138 +1141,673 @@ func (cmd *Command) existsCommand() (int, bool) {
 		}
 	}
 
-	responses = []string{"!1\r\n", ":", strconv.Itoa(count), "\r\n"}
-	if _, wErr = cmd.Connection.Write(writer.BuildResponse(responses)); wErr != nil {
-		return cmd.Index, false
-	}
-	return cmd.Index, true
+	cmd.Writer.Int(count)
+	return cmd.Selected, true
 }
 
-// quitCommand(): Instructs the server to terminate the connection.
-func (cmd *Command) quitCommand() (int, bool) {
-	var wErr error
-	var responses []string
-
-	if len(cmd.Arguments) != 1 {
-		responses = []string{"!1\r\n", "-ERR wrong number of arguments for '", cmd.Arguments[0], "' command\r\n"}
-		if _, wErr = cmd.Connection.Write(writer.BuildResponse(responses)); wErr != nil {
-			return cmd.Index, false
-		}
-		return cmd.Index, true
+// pfaddCommand(): Adds the elements to the HyperLogLog stored at key, creating it prior if it doesn't exist.
+func (cmd *Command) pfaddCommand() (string, bool) {
+	if len(cmd.Arguments) < 2 {
+		cmd.Writer.Error("wrong number of arguments for '" + cmd.Arguments[0] + "' command")
+		return cmd.Selected, true
 	}
-	responses = []string{"!1\r\n", "+OK\r\n"}
-	_, _ = cmd.Connection.Write(writer.BuildResponse(responses))
-	return cmd.Index, false
-}
 
-// infoCommand(): Returns information and statistics about the server in a simple format.
-func (cmd *Command) infoCommand() (int, bool) {
-	var wErr error
+	altered := false
+	_, status := cmd.Database.ModifyStore(
+		cmd.Arguments[1],
+		func(v string, exists bool) (string, bool) {
+			sketch := hyperloglog.New()
+			if exists {
+				var err error
+				if sketch, err = hyperloglog.Decode(v); err != nil {
+					return v, false
+				}
+			}
+			altered = !exists // Creating the key counts as altering it, even without elements
+			for _, element := range cmd.Arguments[2:] {
+				if sketch.Add(element) {
+					altered = true
+				}
+			}
+			if !altered {
+				return v, true
+			}
+			return sketch.Encode(), true
+		},
+	)
 
-	if len(cmd.Arguments) != 1 {
-		responses := []string{"!1\r\n", "-ERR wrong number of arguments for '", cmd.Arguments[0], "' command\r\n"}
-		if _, wErr = cmd.Connection.Write(writer.BuildResponse(responses)); wErr != nil {
-			return cmd.Index, false
+	if !status {
+		cmd.Writer.Error("value is not a valid hyperloglog")
+	} else if altered {
+		cmd.Writer.Int(1)
+	} else {
+		cmd.Writer.Int(0)
+	}
+	return cmd.Selected, true
+}
+
+// pfcountCommand(): Returns the approximated cardinality of the union of the HyperLogLogs stored at the specified keys.
+func (cmd *Command) pfcountCommand() (string, bool) {
+	if len(cmd.Arguments) < 2 {
+		cmd.Writer.Error("wrong number of arguments for '" + cmd.Arguments[0] + "' command")
+		return cmd.Selected, true
+	}
+
+	union, ok := loadSketches(cmd.Database, cmd.Arguments[1:])
+	if !ok {
+		cmd.Writer.Error("value is not a valid hyperloglog")
+		return cmd.Selected, true
+	}
+
+	cmd.Writer.Int(int(union.Count()))
+	return cmd.Selected, true
+}
+
+// pfmergeCommand(): Merges the HyperLogLogs stored at the source keys into the destination key, creating it prior if it doesn't exist.
+func (cmd *Command) pfmergeCommand() (string, bool) {
+	if len(cmd.Arguments) < 2 {
+		cmd.Writer.Error("wrong number of arguments for '" + cmd.Arguments[0] + "' command")
+		return cmd.Selected, true
+	}
+
+	union, ok := loadSketches(cmd.Database, cmd.Arguments[2:])
+	if ok {
+		// New key = new shard, hence the sources are merged prior to the destination
+		_, ok = cmd.Database.LoadModifyStore(
+			cmd.Arguments[1],
+			func(v string) (string, bool) {
+				sketch, err := hyperloglog.Decode(v)
+				if err != nil {
+					return v, false
+				}
+				sketch.Merge(union)
+				return sketch.Encode(), true
+			},
+			hyperloglog.Empty,
+		)
+	}
+
+	if !ok {
+		cmd.Writer.Error("value is not a valid hyperloglog")
+	} else {
+		cmd.Writer.OK()
+	}
+	return cmd.Selected, true
+}
+
+// setbitCommand(): Sets or clears the bit at offset in the value stored at key, growing the value if needed. Returns the old bit.
+func (cmd *Command) setbitCommand() (string, bool) {
+	if len(cmd.Arguments) != 4 {
+		cmd.Writer.Error("wrong number of arguments for '" + cmd.Arguments[0] + "' command")
+		return cmd.Selected, true
+	}
+
+	offset, err := strconv.Atoi(cmd.Arguments[2])
+	if err != nil || offset < 0 || offset >= bitOffsetLimit {
+		cmd.Writer.Error("bit offset is not an integer or out of range")
+		return cmd.Selected, true
+	}
+
+	bit := cmd.Arguments[3]
+	if bit != "0" && bit != "1" {
+		cmd.Writer.Error("bit is not an integer or out of range")
+		return cmd.Selected, true
+	}
+
+	var oldBit byte
+	cmd.Database.LoadModifyStore(
+		cmd.Arguments[1],
+		func(v string) (string, bool) {
+			index := offset / 8
+			mask := byte(0x80) >> (offset % 8)
+			buf := []byte(v)
+			if index >= len(buf) {
+				buf = append(buf, make([]byte, index-len(buf)+1)...)
+			}
+			if buf[index]&mask != 0 {
+				oldBit = 1
+			}
+			if bit == "1" {
+				buf[index] |= mask
+			} else {
+				buf[index] &^= mask
+			}
+			return string(buf), true
+		},
+		"",
+	)
+
+	cmd.Writer.Int(int(oldBit))
+	return cmd.Selected, true
+}
+
+// getbitCommand(): Returns the bit at offset in the value stored at key. Bits beyond the value's length are zero.
+func (cmd *Command) getbitCommand() (string, bool) {
+	if len(cmd.Arguments) != 3 {
+		cmd.Writer.Error("wrong number of arguments for '" + cmd.Arguments[0] + "' command")
+		return cmd.Selected, true
+	}
+
+	offset, err := strconv.Atoi(cmd.Arguments[2])
+	if err != nil || offset < 0 || offset >= bitOffsetLimit {
+		cmd.Writer.Error("bit offset is not an integer or out of range")
+		return cmd.Selected, true
+	}
+
+	bit := 0
+	if value, ok := cmd.Database.Load(cmd.Arguments[1]); ok && offset/8 < len(value) {
+		if value[offset/8]&(byte(0x80)>>(offset%8)) != 0 {
+			bit = 1
 		}
-		return cmd.Index, true
 	}
 
-	totalKeys, _ := cmd.Database.Count()
-	stats := statistics.GetStats(cmd.Index, totalKeys)
-	statCount := len(stats)
+	cmd.Writer.Int(bit)
+	return cmd.Selected, true
+}
 
-	maxSize := statCount*2 + 3
-	var responses = make([]string, 0, maxSize)
-	responses = append(responses, "!", strconv.Itoa(statCount), "\r\n")
-	for _, stat := range stats {
-		responses = append(responses, stat, "\r\n")
+// bitcountCommand(): Counts the set bits in the value stored at key, optionally limited to a byte or bit range.
+func (cmd *Command) bitcountCommand() (string, bool) {
+	clen := len(cmd.Arguments)
+	if clen != 2 && clen != 4 && clen != 5 {
+		cmd.Writer.Error("wrong number of arguments for '" + cmd.Arguments[0] + "' command")
+		return cmd.Selected, true
 	}
 
-	if _, wErr = cmd.Connection.Write(writer.BuildResponse(responses)); wErr != nil {
-		return cmd.Index, false
+	value, _ := cmd.Database.Load(cmd.Arguments[1])
+	first, last, err := parseBitRange(cmd.Arguments[2:], len(value))
+	if err != nil {
+		cmd.Writer.Error(err.Error())
+		return cmd.Selected, true
+	}
+
+	count := 0
+	for offset := first; offset <= last; {
+		if offset%8 == 0 && offset+7 <= last { // Whole byte
+			count += bits.OnesCount8(value[offset/8])
+			offset += 8
+			continue
+		}
+		if value[offset/8]&(byte(0x80)>>(offset%8)) != 0 {
+			count++
+		}
+		offset++
 	}
-	return cmd.Index, true
+
+	cmd.Writer.Int(count)
+	return cmd.Selected, true
 }
 
-// echoCommand(): Returns the message sent by the client. May serve benchmarking purposes.
-func (cmd *Command) echoCommand() (int, bool) {
-	var wErr error
-	var responses []string
+// bitposCommand(): Returns the position of the first bit set to 1 or 0 in the value stored at key, optionally limited to a range.
+func (cmd *Command) bitposCommand() (string, bool) {
+	clen := len(cmd.Arguments)
+	if clen < 3 || clen > 6 {
+		cmd.Writer.Error("wrong number of arguments for '" + cmd.Arguments[0] + "' command")
+		return cmd.Selected, true
+	}
+
+	bit := cmd.Arguments[2]
+	if bit != "0" && bit != "1" {
+		cmd.Writer.Error("bit is not an integer or out of range")
+		return cmd.Selected, true
+	}
+
+	// A missing end of range means the value is considered to be padded with zeros to the right
+	value, _ := cmd.Database.Load(cmd.Arguments[1])
+	rangeArgs := cmd.Arguments[3:]
+	openEnd := len(rangeArgs) < 2
+	if len(rangeArgs) == 1 {
+		rangeArgs = []string{rangeArgs[0], "-1"}
+	}
+	first, last, err := parseBitRange(rangeArgs, len(value))
+	if err != nil {
+		cmd.Writer.Error(err.Error())
+		return cmd.Selected, true
+	}
+
+	position := -1
+	for offset := first; offset <= last; offset++ {
+		set := value[offset/8]&(byte(0x80)>>(offset%8)) != 0
+		if set == (bit == "1") {
+			position = offset
+			break
+		}
+	}
+	if position == -1 && bit == "0" && openEnd && first <= last {
+		position = len(value) * 8
+	} else if position == -1 && bit == "0" && len(value) == 0 {
+		position = 0
+	}
 
+	cmd.Writer.Int(position)
+	return cmd.Selected, true
+}
+
+// bitopCommand(): Performs a bitwise operation between the source keys and stores the result in the destination key.
+func (cmd *Command) bitopCommand() (string, bool) {
+	clen := len(cmd.Arguments)
+	if clen < 4 {
+		cmd.Writer.Error("wrong number of arguments for '" + cmd.Arguments[0] + "' command")
+		return cmd.Selected, true
+	}
+
+	operation := strings.ToUpper(cmd.Arguments[1])
+	if !slices.Contains([]string{"AND", "OR", "XOR", "NOT"}, operation) {
+		cmd.Writer.Error("unknown option")
+		return cmd.Selected, true
+	}
+	if operation == "NOT" && clen != 4 {
+		cmd.Writer.Error("'BITOP NOT' requires exactly one source key")
+		return cmd.Selected, true
+	}
+
+	// New keys = new shards, hence the separate load and store ops
+	sources := make([]string, 0, clen-3)
+	maxLen := 0
+	for _, k := range cmd.Arguments[3:] {
+		value, _ := cmd.Database.Load(k)
+		sources = append(sources, value)
+		maxLen = max(maxLen, len(value))
+	}
+
+	result := make([]byte, maxLen)
+	for i := range result {
+		var b byte
+		for j, source := range sources {
+			var cur byte // Shorter values are zero-padded
+			if i < len(source) {
+				cur = source[i]
+			}
+			switch {
+			case operation == "NOT":
+				b = ^cur
+			case j == 0:
+				b = cur
+			case operation == "AND":
+				b &= cur
+			case operation == "OR":
+				b |= cur
+			case operation == "XOR":
+				b ^= cur
+			}
+		}
+		result[i] = b
+	}
+
+	if maxLen == 0 {
+		cmd.Database.Delete(cmd.Arguments[2])
+	} else {
+		cmd.Database.Store(cmd.Arguments[2], string(result))
+	}
+
+	cmd.Writer.Int(maxLen)
+	return cmd.Selected, true
+}
+
+// scanCommand(): Incrementally iterates over the keys of the current database. The cursor selects the next shard to visit, see memory.Scan().
+func (cmd *Command) scanCommand() (string, bool) {
+	var match, keyType string
+	syntaxError, checkMatch, checkCount, checkType := false, false, false, false
+
+	clen := len(cmd.Arguments)
+	if clen < 2 || clen > 8 {
+		cmd.Writer.Error("wrong number of arguments for '" + cmd.Arguments[0] + "' command")
+		return cmd.Selected, true
+	}
+
+	cursor, err := strconv.Atoi(cmd.Arguments[1])
+	if err != nil || cursor < 0 || cursor >= shardLimit {
+		cmd.Writer.Error("invalid cursor")
+		return cmd.Selected, true
+	}
+
+	// Parse
+	count := scanDefaultCount
+	for idx := 2; idx < clen && !syntaxError; idx += 2 {
+		option := strings.ToUpper(cmd.Arguments[idx])
+		if idx+1 >= clen {
+			syntaxError = true
+		} else if option == "MATCH" && !checkMatch {
+			match = cmd.Arguments[idx+1]
+			checkMatch = true
+		} else if option == "COUNT" && !checkCount {
+			count, err = strconv.Atoi(cmd.Arguments[idx+1])
+			if err != nil || count < 1 {
+				syntaxError = true
+			}
+			checkCount = true
+		} else if option == "TYPE" && !checkType {
+			keyType = strings.ToLower(cmd.Arguments[idx+1])
+			checkType = true
+		} else {
+			syntaxError = true
+		}
+	}
+	if syntaxError {
+		cmd.Writer.Error("wrong syntax for '" + cmd.Arguments[0] + "' command")
+		return cmd.Selected, true
+	}
+
+	// Run: whole shards are visited at once, so keys present during the entire scan are never missed
+	var keys, shardKeys []string
+	prefix := cmd.keyPrefix()
+	visited := 0
+	for visited < count {
+		shardKeys, cursor = cmd.Database.Scan(cursor)
+		for _, key := range shardKeys {
+			visited++
+			if !cmd.keyVisible(key) { // Outside of the namespace or not permitted
+				continue
+			}
+			key = key[len(prefix):]
+			if checkMatch && !glob.Match(match, key) {
+				continue
+			}
+			if checkType && keyType != "string" { // All values are strings
+				continue
+			}
+			keys = append(keys, key)
+		}
+		if cursor == 0 {
+			break
+		}
+	}
+
+	if cmd.RESP != 0 { // Redis clients expect the keys nested in an array of their own
+		cmd.Writer.Array(2)
+		cmd.Writer.Bulk(strconv.Itoa(cursor))
+		cmd.Writer.Array(len(keys))
+	} else {
+		cmd.Writer.Array(len(keys) + 1)
+		cmd.Writer.Bulk(strconv.Itoa(cursor))
+	}
+	for _, key := range keys {
+		cmd.Writer.Bulk(key)
+	}
+
+	return cmd.Selected, true
+}
+
+// keysCommand(): Returns all keys of the current database matching the pattern. Requires elevated privileges.
+func (cmd *Command) keysCommand() (string, bool) {
 	if len(cmd.Arguments) != 2 {
-		responses = []string{"!1\r\n", "-ERR wrong number of arguments for '", cmd.Arguments[0], "' command\r\n"}
-		if _, wErr = cmd.Connection.Write(writer.BuildResponse(responses)); wErr != nil {
-			return cmd.Index, false
+		cmd.Writer.Error("wrong number of arguments for '" + cmd.Arguments[0] + "' command")
+		return cmd.Selected, true
+	}
+
+	if !cmd.privileged() {
+		cmd.Writer.Error("insufficient permissions")
+		return cmd.Selected, true
+	}
+
+	var keys []string
+	prefix := cmd.keyPrefix()
+	for _, key := range cmd.Database.Keys() {
+		if cmd.keyVisible(key) && glob.Match(cmd.Arguments[1], key[len(prefix):]) {
+			keys = append(keys, key[len(prefix):])
 		}
-		return cmd.Index, true
 	}
 
-	responses = []string{"!1\r\n", cmd.Arguments[1], "\r\n"}
-	if _, wErr = cmd.Connection.Write(writer.BuildResponse(responses)); wErr != nil {
-		return cmd.Index, false
+	cmd.Writer.Array(len(keys))
+	for _, key := range keys {
+		cmd.Writer.Bulk(key)
 	}
-	return cmd.Index, true
+
+	return cmd.Selected, true
 }
 
-// flushCommand(): Deletes all of the keys in the current database. Requires elevated privileges.
-func (cmd *Command) flushCommand() (int, bool) {
-	var wErr error
-	var responses []string
+// randomkeyCommand(): Returns a random key of the current database, or nil if it's empty. Requires elevated privileges.
+func (cmd *Command) randomkeyCommand() (string, bool) {
+	if len(cmd.Arguments) != 1 {
+		cmd.Writer.Error("wrong number of arguments for '" + cmd.Arguments[0] + "' command")
+		return cmd.Selected, true
+	}
+
+	if !cmd.privileged() {
+		cmd.Writer.Error("insufficient permissions")
+		return cmd.Selected, true
+	}
+
+	prefix := cmd.keyPrefix()
+	if key, ok := cmd.Database.RandomKey(cmd.keyVisible); ok {
+		cmd.Writer.Bulk(strings.TrimPrefix(key, prefix))
+	} else {
+		cmd.Writer.Nil()
+	}
+	return cmd.Selected, true
+}
+
+// memoryCommand(): Introspects the memory usage. 'MEMORY USAGE key' returns the approximate number of bytes used by the key and its value.
+func (cmd *Command) memoryCommand() (string, bool) {
+	if len(cmd.Arguments) != 3 {
+		cmd.Writer.Error("wrong number of arguments for '" + cmd.Arguments[0] + "' command")
+		return cmd.Selected, true
+	}
+
+	if strings.ToUpper(cmd.Arguments[1]) != "USAGE" {
+		cmd.Writer.Error("unknown subcommand '" + cmd.Arguments[1] + "'")
+		return cmd.Selected, true
+	}
+
+	if info, ok := cmd.Database.Inspect(cmd.Arguments[2]); ok {
+		cmd.Writer.Int(info.Size)
+	} else {
+		cmd.Writer.Nil()
+	}
+	return cmd.Selected, true
+}
+
+// objectCommand(): Introspects a key without counting as an access, e.g. 'OBJECT IDLETIME key', 'OBJECT FREQ key' or 'OBJECT ENCODING key'.
+func (cmd *Command) objectCommand() (string, bool) {
+	if len(cmd.Arguments) != 3 {
+		cmd.Writer.Error("wrong number of arguments for '" + cmd.Arguments[0] + "' command")
+		return cmd.Selected, true
+	}
 
+	subcommand := strings.ToUpper(cmd.Arguments[1])
+	if !slices.Contains([]string{"IDLETIME", "FREQ", "ENCODING"}, subcommand) {
+		cmd.Writer.Error("unknown subcommand '" + cmd.Arguments[1] + "'")
+		return cmd.Selected, true
+	}
+
+	info, ok := cmd.Database.Inspect(cmd.Arguments[2])
+	if !ok {
+		cmd.Writer.Nil()
+	} else if subcommand == "IDLETIME" {
+		cmd.Writer.Int(int(info.Idle.Seconds()))
+	} else if subcommand == "FREQ" {
+		cmd.Writer.Int(int(info.Frequency))
+	} else { // ENCODING
+		cmd.Writer.Bulk(valueEncoding(info.Value))
+	}
+	return cmd.Selected, true
+}
+
+// quitCommand(): Instructs the server to terminate the connection.
+func (cmd *Command) quitCommand() (string, bool) {
 	if len(cmd.Arguments) != 1 {
-		responses = []string{"!1\r\n", "-ERR wrong number of arguments for '", cmd.Arguments[0], "' command\r\n"}
-		if _, wErr = cmd.Connection.Write(writer.BuildResponse(responses)); wErr != nil {
-			return cmd.Index, false
+		cmd.Writer.Error("wrong number of arguments for '" + cmd.Arguments[0] + "' command")
+		return cmd.Selected, true
+	}
+	cmd.Writer.OK()
+	return cmd.Selected, false
+}
+
+// infoCommand(): Returns information and statistics about the server in a simple format. Optionally limited to a section.
+func (cmd *Command) infoCommand() (string, bool) {
+	clen := len(cmd.Arguments)
+	if clen > 2 {
+		cmd.Writer.Error("wrong number of arguments for '" + cmd.Arguments[0] + "' command")
+		return cmd.Selected, true
+	}
+
+	section := "default"
+	if clen == 2 {
+		section = strings.ToLower(cmd.Arguments[1])
+	}
+
+	var stats []string
+	switch section {
+	case "default", "all":
+		totalKeys, subtotal := cmd.Database.Count()
+		stats = statistics.GetStats(cmd.Selected, totalKeys, cmd.Database.ShardCount(), len(memory.Container.Names()))
+		stats = append(stats, statistics.GetMemoryStats(memory.UsedMemory(), memory.EvictedKeys())...)
+		stats = append(stats, statistics.GetShardSummary(subtotal, cmd.Database.LockStats())...)
+		stats = append(stats, statistics.GetReshardStats(cmd.Database.ReshardProgress())...)
+		if section == "default" {
+			break
+		}
+		fallthrough
+	case "keyspace":
+		if cmd.Namespace != "" { // The counts would include the keys of other namespaces
+			cmd.Writer.Error("section '" + section + "' not allowed within a namespace")
+			return cmd.Selected, true
+		}
+		var names []string
+		var keys, expiring []int
+		for _, name := range memory.Container.Names() {
+			if cmd.User != nil && !cmd.Admin && cmd.User.PermitDatabase(name) != nil { // Only the databases the user may access
+				continue
+			}
+			database, ok := memory.Container.Load(name)
+			if !ok { // Dropped in the meantime
+				continue
+			}
+			totalKeys, _ := database.Count()
+			names = append(names, name)
+			keys = append(keys, totalKeys)
+			expiring = append(expiring, database.CountExpiring())
 		}
-		return cmd.Index, true
+		stats = append(stats, statistics.GetKeyspaceStats(names, keys, expiring)...)
+	case "memory":
+		_, subtotal := cmd.Database.Count()
+		stats = statistics.GetMemoryStats(memory.UsedMemory(), memory.EvictedKeys())
+		stats = append(stats, statistics.GetShardSummary(subtotal, cmd.Database.LockStats())...)
+		stats = append(stats, statistics.GetReshardStats(cmd.Database.ReshardProgress())...)
+	default:
+		cmd.Writer.Error("unknown section '" + cmd.Arguments[1] + "'")
+		return cmd.Selected, true
+	}
+	if cmd.RESP != 0 { // Redis clients expect a single value of lines
+		cmd.Writer.Bulk(strings.Join(stats, "\r\n"))
+		return cmd.Selected, true
+	}
+	cmd.Writer.Array(len(stats))
+	for _, stat := range stats {
+		cmd.Writer.Bulk(stat)
+	}
+
+	return cmd.Selected, true
+}
+
+// echoCommand(): Returns the message sent by the client. May serve benchmarking purposes.
+func (cmd *Command) echoCommand() (string, bool) {
+	if len(cmd.Arguments) != 2 {
+		cmd.Writer.Error("wrong number of arguments for '" + cmd.Arguments[0] + "' command")
+		return cmd.Selected, true
+	}
+
+	cmd.Writer.Bulk(cmd.Arguments[1])
+	return cmd.Selected, true
+}
+
+// pingCommand(): Returns '+PONG', or the message if one is given. Used by Redis clients to check the connection.
+func (cmd *Command) pingCommand() (string, bool) {
+	switch len(cmd.Arguments) {
+	case 1:
+		cmd.Writer.Status("PONG")
+	case 2:
+		cmd.Writer.Bulk(cmd.Arguments[1])
+	default:
+		cmd.Writer.Error("wrong number of arguments for '" + cmd.Arguments[0] + "' command")
+	}
+	return cmd.Selected, true
+}
+
+// debugCommand(): Returns internal details of the current database. 'DEBUG SHARDS' returns the key distribution and lock metrics per shard.
+func (cmd *Command) debugCommand() (string, bool) {
+	if len(cmd.Arguments) != 2 {
+		cmd.Writer.Error("wrong number of arguments for '" + cmd.Arguments[0] + "' command")
+		return cmd.Selected, true
+	}
+
+	if strings.ToUpper(cmd.Arguments[1]) != "SHARDS" {
+		cmd.Writer.Error("unknown subcommand '" + cmd.Arguments[1] + "'")
+		return cmd.Selected, true
+	}
+
+	_, subtotal := cmd.Database.Count()
+	stats := statistics.GetShardStats(subtotal, cmd.Database.LockStats())
+	cmd.Writer.Array(len(stats))
+	for _, stat := range stats {
+		cmd.Writer.Bulk(stat)
+	}
+
+	return cmd.Selected, true
+}
+
+// reshardCommand(): Migrates the current database to a new number of shards in the background, while it keeps serving commands. Requires elevated privileges.
+func (cmd *Command) reshardCommand() (string, bool) {
+	if len(cmd.Arguments) != 2 {
+		cmd.Writer.Error("wrong number of arguments for '" + cmd.Arguments[0] + "' command")
+		return cmd.Selected, true
+	}
+
+	if !cmd.privileged() {
+		cmd.Writer.Error("insufficient permissions")
+		return cmd.Selected, true
+	}
+
+	shardCount, err := strconv.Atoi(cmd.Arguments[1])
+	if err != nil || shardCount < 1 || shardCount > shardLimit {
+		cmd.Writer.Error("shard count must be between 1 and " + strconv.Itoa(shardLimit))
+		return cmd.Selected, true
+	}
+
+	if !cmd.Database.Reshard(shardCount) {
+		cmd.Writer.Error("resharding already in progress")
+		return cmd.Selected, true
+	}
+
+	cmd.Writer.OK()
+	return cmd.Selected, true
+}
+
+// flushCommand(): Deletes all of the keys in the current database. Requires elevated privileges.
+func (cmd *Command) flushCommand() (string, bool) {
+	if len(cmd.Arguments) != 1 {
+		cmd.Writer.Error("wrong number of arguments for '" + cmd.Arguments[0] + "' command")
+		return cmd.Selected, true
 	}
 
-	address := cmd.Connection.RemoteAddr()
-	if isAdmin(address) {
+	if cmd.privileged() {
 		cmd.Database.Clear()
-		responses = []string{"!1\r\n", "+OK\r\n"}
-		_, wErr = cmd.Connection.Write(writer.BuildResponse(responses))
+		cmd.Writer.OK()
 	} else {
-		responses = []string{"!1\r\n", "-ERR insufficient permissions\r\n"}
-		_, wErr = cmd.Connection.Write(writer.BuildResponse(responses))
-	}
-	if wErr != nil {
-		return cmd.Index, false
+		cmd.Writer.Error("insufficient permissions")
 	}
-	return cmd.Index, true
+	return cmd.Selected, true
 }
 
 // shutdownCommand(): Used to externally trigger a graceful shutdown. Requires elevated privileges.
-func (cmd *Command) shutdownCommand() (int, bool) {
-	var wErr error
-	var responses []string
-
+func (cmd *Command) shutdownCommand() (string, bool) {
 	if len(cmd.Arguments) != 1 {
-		responses = []string{"!1\r\n", "-ERR wrong number of arguments for '", cmd.Arguments[0], "' command\r\n"}
-		if _, wErr = cmd.Connection.Write(writer.BuildResponse(responses)); wErr != nil {
-			return cmd.Index, false
-		}
-		return cmd.Index, true
+		cmd.Writer.Error("wrong number of arguments for '" + cmd.Arguments[0] + "' command")
+		return cmd.Selected, true
 	}
 
-	address := cmd.Connection.RemoteAddr()
-	if isAdmin(address) {
+	if cmd.privileged() {
 		syscall.Kill(statistics.ProcessId, syscall.SIGINT)
-		responses = []string{"!1\r\n", "+OK\r\n"}
-		_, _ = cmd.Connection.Write(writer.BuildResponse(responses))
-		return cmd.Index, false
-	}
-	responses = []string{"!1\r\n", "-ERR insufficient permissions\r\n"}
-	if _, wErr = cmd.Connection.Write(writer.BuildResponse(responses)); wErr != nil {
-		return cmd.Index, false
+		cmd.Writer.OK()
+		return cmd.Selected, false
 	}
-	return cmd.Index, true
+	cmd.Writer.Error("insufficient permissions")
+	return cmd.Selected, true
 }
 
 /* extras */
 
 // setExpiration(): Handles expiration when passed as part of the 'SET' command.
-func setExpiration(key string, option string, ttl string, database memory.ShardedCache) {
+func setExpiration(key string, option string, ttl string, database *memory.ShardedCache) {
 	value, _ := strconv.Atoi(ttl) // Returns '0' on error
 	if value == 0 {               // No need to start a goroutine for that
 		return
@@ -922,24 +1820,269 @@ func setExpiration(key string, option string, ttl string, database memory.Sharde
 		duration = time.Second * time.Duration(value)
 	}
 
+	key = strings.Clone(key) // Kept until the deadline, not the whole request
+	deadline := time.Now().Add(duration)
+	database.Expire(key, deadline)
 	go func() {
 		time.Sleep(duration)
-		database.Delete(key)
+		database.DeleteExpired(key, deadline) // Unless it was overwritten meanwhile
 	}()
 }
 
-// isAdmin(): Checks whether or not the current client is connected locally, thus having administrative permissions.
-func isAdmin(address net.Addr) bool {
-	localIPv4 := "127.0.0.1"
-	localIPv6 := "[::1]"
-	networkUNIX := "unix" // INFO: There's "unix", "unixgram" and "unixpacket"
+// loadSketches(): Loads and merges the HyperLogLogs stored at the given keys. Keys that don't exist are treated as empty.
+func loadSketches(database *memory.ShardedCache, keys []string) (hyperloglog.Sketch, bool) {
+	union := hyperloglog.New()
+	for _, key := range keys {
+		value, ok := database.Load(key)
+		if !ok {
+			continue
+		}
+		sketch, err := hyperloglog.Decode(value)
+		if err != nil {
+			return nil, false
+		}
+		union.Merge(sketch)
+	}
+	return union, true
+}
+
+// parseBitRange(): Parses optional 'start end [BYTE|BIT]' arguments into an inclusive range of bit offsets. Negative indices count from the end.
+func parseBitRange(args []string, valueLen int) (int, int, error) {
+	if len(args) == 0 {
+		return 0, valueLen*8 - 1, nil
+	}
+
+	start, err := strconv.Atoi(args[0])
+	if err != nil {
+		return 0, -1, errors.New("value is not an integer or out of range")
+	}
+	end, err := strconv.Atoi(args[1])
+	if err != nil {
+		return 0, -1, errors.New("value is not an integer or out of range")
+	}
+
+	unit := "BYTE"
+	if len(args) == 3 {
+		unit = strings.ToUpper(args[2])
+		if unit != "BYTE" && unit != "BIT" {
+			return 0, -1, errors.New("wrong syntax for range")
+		}
+	}
+
+	length := valueLen
+	if unit == "BIT" {
+		length = valueLen * 8
+	}
+	start, end, ok := normalizeRange(start, end, length)
+	if !ok {
+		return 0, -1, nil
+	}
+	if unit == "BYTE" {
+		return start * 8, end*8 + 7, nil
+	}
+	return start, end, nil
+}
+
+// normalizeRange(): Resolves negative indices and clamps an inclusive range to the given length. Returns false if the range is empty.
+func normalizeRange(start, end, length int) (int, int, bool) {
+	if start < 0 {
+		start = max(length+start, 0)
+	}
+	if end < 0 {
+		end = length + end
+	}
+	end = min(end, length-1)
+	if start > end || length == 0 {
+		return 0, -1, false
+	}
+	return start, end, true
+}
+
+// counterBounds contains the optional limits of a bounded counter.
+type counterBounds struct {
+	min      int
+	max      int
+	saturate bool
+}
+
+// isCounterOption(): Checks whether the argument starts the options of a counter command.
+func isCounterOption(arg string) bool {
+	return slices.Contains([]string{"MIN", "MAX", "SATURATE"}, strings.ToUpper(arg))
+}
+
+// parseCounterOptions(): Parses the optional 'MIN m', 'MAX m' and 'SATURATE' arguments of the counter commands.
+func parseCounterOptions(options []string) (counterBounds, error) {
+	bounds := counterBounds{min: math.MinInt, max: math.MaxInt}
+	checkMin, checkMax := false, false
+
+	for idx := 0; idx < len(options); idx++ {
+		option := strings.ToUpper(options[idx])
+		switch {
+		case option == "SATURATE" && !bounds.saturate:
+			bounds.saturate = true
+		case (option == "MIN" && !checkMin) || (option == "MAX" && !checkMax):
+			idx += 1
+			if idx >= len(options) {
+				return bounds, errCounterSyntax
+			}
+			limit, err := strconv.Atoi(options[idx])
+			if err != nil {
+				return bounds, errCounterLimit
+			}
+			if option == "MIN" {
+				bounds.min, checkMin = limit, true
+			} else {
+				bounds.max, checkMax = limit, true
+			}
+		default:
+			return bounds, errCounterSyntax
+		}
+	}
+
+	if bounds.min > bounds.max {
+		return bounds, errCounterLimit
+	}
+	return bounds, nil
+}
+
+// applyDelta(): Adds the delta to the integer value, guarding against overflows. Results beyond the bounds either saturate or fail.
+func applyDelta(value string, delta int, bounds counterBounds) (int, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, errNotInteger
+	}
+
+	var overflow bool
+	if delta > 0 && n > math.MaxInt-delta {
+		n, overflow = math.MaxInt, true
+	} else if delta < 0 && n < math.MinInt-delta {
+		n, overflow = math.MinInt, true
+	} else {
+		n += delta
+	}
+
+	if bounds.saturate { // Overflows saturate at the integer limits as well
+		return min(max(n, bounds.min), bounds.max), nil
+	}
+	if overflow {
+		return 0, errNotInteger
+	}
+	if n > bounds.max || n < bounds.min {
+		return 0, errCounterBounds
+	}
+	return n, nil
+}
+
+// valueEncoding(): Describes how a value is interpreted by the commands: "int", "hyperloglog" or "raw".
+func valueEncoding(value string) string {
+	if _, err := strconv.Atoi(value); err == nil {
+		return "int"
+	}
+	if _, err := hyperloglog.Decode(value); err == nil {
+		return "hyperloglog"
+	}
+	return "raw"
+}
+
+// authenticate(): Authenticates the session, confining it to the user's namespace if there is one.
+// Failures are delayed, and once there are AuthMaxFailures of them, errAuthFailures tells to close the session.
+func (cmd *Command) authenticate(name, password string) error {
+	if !auth.Enabled() {
+		return errAuthDisabled
+	}
+	user, ok := auth.Authenticate(name, password)
+	if !ok {
+		cmd.Failures++
+		time.Sleep(config.AuthFailureDelay * time.Millisecond)
+		if config.AuthMaxFailures > 0 && cmd.Failures >= config.AuthMaxFailures {
+			return errAuthFailures
+		}
+		return errAuthFailed
+	}
+	cmd.User = user
+	if namespace := user.Namespace(); namespace != "" {
+		cmd.Namespace = namespace
+	}
+	return nil
+}
+
+// keyPrefix(): Returns the prefix of the keys within the session's namespace, empty if there's none.
+func (cmd *Command) keyPrefix() string {
+	if cmd.Namespace == "" {
+		return ""
+	}
+	return cmd.Namespace + ":"
+}
+
+// keyIndexes(): Returns the positions of the key arguments of the command.
+func (cmd *Command) keyIndexes(command string) []int {
+	spec, ok := keyArguments[command]
+	if !ok {
+		return nil
+	}
+	last := spec.last
+	if last < 0 {
+		last += len(cmd.Arguments)
+	}
+	var indexes []int
+	for i := spec.first; i <= last && i < len(cmd.Arguments); i += spec.step {
+		indexes = append(indexes, i)
+	}
+	return indexes
+}
+
+// prefixKeys(): Prefixes the key arguments of the command with the session's namespace.
+func (cmd *Command) prefixKeys(command string) {
+	prefix := cmd.keyPrefix()
+	for _, i := range cmd.keyIndexes(command) {
+		cmd.Arguments[i] = prefix + cmd.Arguments[i]
+	}
+}
+
+// permit(): Checks the command, its keys (including the namespace prefix) and the selected database against the ACL of the user.
+func (cmd *Command) permit(command string) error {
+	name := cmd.name(command)
+	categories, ok := commandCategories[name]
+	if !ok { // Denied unless listed, so a command added without categories isn't open to everyone
+		return errors.New("no permissions to run the '" + strings.ToLower(name) + "' command")
+	}
+	if len(categories) == 0 {
+		return nil
+	}
+
+	var keys []string
+	for _, i := range cmd.keyIndexes(command) {
+		keys = append(keys, cmd.Arguments[i])
+	}
+	var database string
+	if !slices.Contains(sessionCommands, command) {
+		database = cmd.Selected
+	}
+	return cmd.User.Permit(name, categories, keys, database)
+}
+
+// name(): Returns the name of the command, including the subcommand as 'command|subcommand' for commands whose subcommands are told apart.
+func (cmd *Command) name(command string) string {
+	if slices.Contains(subcommandCommands, command) && len(cmd.Arguments) > 1 {
+		return command + "|" + strings.ToUpper(cmd.Arguments[1])
+	}
+	return command
+}
 
-	addressString := address.String()
-	addressNetwork := address.Network()
-	if addressNetwork == networkUNIX {
-		return true
-	} else if strings.Contains(addressString, localIPv4) || strings.Contains(addressString, localIPv6) {
-		return true
+// permitDatabase(): Checks whether the session may access the database, e.g. before selecting it.
+func (cmd *Command) permitDatabase(name string) error {
+	if cmd.User == nil {
+		return nil
 	}
-	return false
+	return cmd.User.PermitDatabase(name)
+}
+
+// keyVisible(): Reports whether a key returned by 'SCAN', 'KEYS' or 'RANDOMKEY' is within the namespace and permitted by the ACL.
+func (cmd *Command) keyVisible(key string) bool {
+	return strings.HasPrefix(key, cmd.keyPrefix()) && (cmd.User == nil || cmd.User.PermitKey(key))
+}
+
+// privileged(): Checks whether the session may run administrative commands: sessions of the admin listener and, as the ACL decides before dispatch, authenticated ones.
+func (cmd *Command) privileged() bool {
+	return cmd.Admin || cmd.User != nil
 }
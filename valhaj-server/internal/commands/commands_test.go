@@ -0,0 +1,216 @@
+package commands
+
+import (
+	"bytes"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"lj.com/valhaj/internal/auth"
+	"lj.com/valhaj/internal/memory"
+	"lj.com/valhaj/internal/writer"
+)
+
+// bufferConn collects the written replies.
+type bufferConn struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (c *bufferConn) Write(b []byte) (int, error) {
+	return c.buf.Write(b)
+}
+
+// newTestCommand(): Returns a command of an admin session, which doesn't need to authenticate, with its own database.
+func newTestCommand(args ...string) (*Command, *bufferConn) {
+	conn := &bufferConn{}
+	cmd := &Command{
+		Arguments:  args,
+		Connection: conn,
+		Writer:     writer.NewWriter(conn),
+		Selected:   "0",
+		Database:   memory.NewShardedCache(4),
+		Admin:      true,
+		Protocol:   1,
+	}
+	return cmd, conn
+}
+
+// reply(): Executes the command and returns its reply.
+func reply(t *testing.T, cmd *Command, conn *bufferConn) string {
+	t.Helper()
+	conn.buf.Reset()
+	cmd.Execute()
+	if err := cmd.Writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return conn.buf.String()
+}
+
+// loadTestUser(): Loads a users file with a single user from a temporary directory and returns the user.
+func loadTestUser(t *testing.T, line string) *auth.User {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "users.acl")
+	if err := os.WriteFile(filename, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := auth.LoadUsers(filename); err != nil {
+		t.Fatal(err)
+	}
+	user, ok := auth.LookupUser(strings.Fields(line)[0])
+	if !ok {
+		t.Fatal("user wasn't loaded")
+	}
+	return user
+}
+
+func TestPrefixKeys(t *testing.T) {
+	// Key arguments are named 'key...', no other argument starts with 'key'
+	invocations := [][]string{
+		{"MOVE", "key1", "1"}, {"GET", "key1"}, {"SET", "key1", "v"}, {"GETSET", "key1", "v"}, {"GETDEL", "key1"},
+		{"INCR", "key1"}, {"DECR", "key1"}, {"INCRBY", "key1", "2"}, {"DECRBY", "key1", "2"}, {"INCRBYFLOAT", "key1", "1.5"},
+		{"APPEND", "key1", "v"}, {"PREPEND", "key1", "v"}, {"LEN", "key1", "key2", "key3"}, {"STRLEN", "key1"},
+		{"GETRANGE", "key1", "0", "1"}, {"SETRANGE", "key1", "0", "v"}, {"PFADD", "key1", "a", "b"},
+		{"SETBIT", "key1", "0", "1"}, {"GETBIT", "key1", "0"}, {"BITCOUNT", "key1"}, {"BITPOS", "key1", "1"},
+		{"RENAME", "key1", "key2"}, {"COPY", "key1", "key2"},
+		{"MGET", "key1", "key2", "key3"}, {"DEL", "key1", "key2"}, {"EXISTS", "key1", "key2"},
+		{"PFCOUNT", "key1", "key2"}, {"PFMERGE", "key1", "key2", "key3"},
+		{"MSET", "key1", "v", "key2", "v"}, {"BITOP", "AND", "key1", "key2", "key3"},
+		{"MEMORY", "USAGE", "key1"}, {"OBJECT", "ENCODING", "key1"},
+	}
+
+	tested := make(map[string]bool)
+	for _, args := range invocations {
+		tested[args[0]] = true
+		cmd, _ := newTestCommand(append([]string(nil), args...)...)
+		cmd.Namespace = "team-a"
+		cmd.Execute()
+		for i, arg := range args {
+			want := arg
+			if strings.HasPrefix(arg, "key") {
+				want = "team-a:" + arg
+			}
+			if cmd.Arguments[i] != want {
+				t.Errorf("%q: got argument %d '%s', want '%s'", args, i, cmd.Arguments[i], want)
+			}
+		}
+	}
+	for command := range keyArguments {
+		if !tested[command] {
+			t.Errorf("command '%s' with key arguments isn't tested", command)
+		}
+	}
+}
+
+func TestPermitKeys(t *testing.T) {
+	user := loadTestUser(t, "app on nopass +@all ~app:* db=*")
+	tests := []struct {
+		args      []string
+		forbidden bool
+	}{
+		{[]string{"MGET", "app:1", "app:2"}, false},
+		{[]string{"MGET", "app:1", "secret"}, true},
+		{[]string{"EXISTS", "app:1", "app:2"}, false},
+		{[]string{"EXISTS", "app:1", "secret"}, true},
+		{[]string{"LEN", "app:1", "app:2"}, false},
+		{[]string{"LEN", "app:1", "secret"}, true},
+		{[]string{"PFCOUNT", "app:1", "app:2"}, false},
+		{[]string{"PFCOUNT", "app:1", "secret"}, true},
+		{[]string{"BITOP", "OR", "app:1", "app:2", "app:3"}, false},
+		{[]string{"BITOP", "OR", "app:1", "app:2", "secret"}, true},
+		{[]string{"BITOP", "OR", "secret", "app:1"}, true},
+		{[]string{"MSET", "app:1", "v", "secret", "v"}, true},
+		{[]string{"DEL", "app:1", "secret"}, true},
+		{[]string{"PFMERGE", "app:1", "secret"}, true},
+	}
+	for _, test := range tests {
+		cmd, conn := newTestCommand(test.args...)
+		cmd.Admin, cmd.User = false, user
+		got := reply(t, cmd, conn)
+		if forbidden := strings.Contains(got, "no permissions to access a key"); forbidden != test.forbidden {
+			t.Errorf("%q: got reply %q", test.args, got)
+		}
+	}
+}
+
+// executeCases(): Returns the commands dispatched by Execute(), parsed from the cases of its switch.
+func executeCases(t *testing.T) []string {
+	t.Helper()
+	file, err := parser.ParseFile(token.NewFileSet(), "commands.go", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var commands []string
+	for _, decl := range file.Decls {
+		if fn, ok := decl.(*ast.FuncDecl); !ok || fn.Name.Name != "Execute" {
+			continue
+		}
+		ast.Inspect(decl, func(node ast.Node) bool {
+			if clause, ok := node.(*ast.CaseClause); ok {
+				for _, expr := range clause.List {
+					if lit, ok := expr.(*ast.BasicLit); ok && lit.Kind == token.STRING {
+						command, _ := strconv.Unquote(lit.Value)
+						commands = append(commands, command)
+					}
+				}
+			}
+			return true
+		})
+	}
+	if len(commands) == 0 {
+		t.Fatal("no commands found in Execute()")
+	}
+	return commands
+}
+
+func TestCommandCategories(t *testing.T) {
+	for _, command := range executeCases(t) {
+		if slices.Contains(subcommandCommands, command) { // Listed per subcommand
+			found := false
+			for name := range commandCategories {
+				found = found || strings.HasPrefix(name, command+"|")
+			}
+			if !found {
+				t.Errorf("command '%s' has no subcommands in commandCategories", command)
+			}
+		} else if _, ok := commandCategories[command]; !ok {
+			t.Errorf("command '%s' is missing in commandCategories", command)
+		}
+	}
+
+	// Commands that aren't listed are denied
+	user := loadTestUser(t, "app on nopass +@all ~* db=*")
+	cmd, conn := newTestCommand("DB")
+	cmd.Admin, cmd.User = false, user
+	if got := reply(t, cmd, conn); !strings.Contains(got, "no permissions to run the 'db' command") {
+		t.Fatalf("got reply %q", got)
+	}
+}
+
+func TestLen(t *testing.T) {
+	tests := []struct {
+		protocol int
+		resp     int
+		want     string
+	}{
+		{1, 0, "!2\r\n$6\r\n$-1\r\n"},
+		{2, 0, "!2\r\n:6\r\n$-1\r\n"},
+		{1, 2, "*2\r\n:6\r\n$-1\r\n"},
+	}
+	for _, test := range tests {
+		cmd, conn := newTestCommand("LEN", "key", "missing")
+		cmd.Database.Store("key", "value1")
+		cmd.Protocol, cmd.RESP = test.protocol, test.resp
+		cmd.Writer.SetProtocol(test.protocol)
+		if got := reply(t, cmd, conn); got != test.want {
+			t.Errorf("protocol %d, RESP %d: got %q, want %q", test.protocol, test.resp, got, test.want)
+		}
+	}
+}
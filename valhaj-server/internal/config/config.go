@@ -12,10 +12,39 @@ const (
 	ServerInetNetwork           = "tcp"
 	ServerInetAddress           = "0.0.0.0:6380"
 	ServerGracefulShutdownDelay = 1000
+	ServerAdminNetwork          = "unix"                 // Sessions of the admin listener have administrative permissions
+	ServerAdminAddress          = "./sockets/admin.sock" // Its directory is only accessible by the owner. Empty to disable the admin listener
+	ServerProxyNetwork          = "unix"                 // Sessions of the proxy listener must send a PROXY protocol header, see valhaj-proxy
+	ServerProxyAddress          = "./sockets/proxy.sock" // Its directory is only accessible by the owner. Empty to disable the proxy listener
+	ServerTrustedProxies        = ""                     // Comma-separated CIDRs or IP addresses of TCP clients, which must send a PROXY protocol header
+	ServerTLS                   = false                  // Terminates TLS in the server itself, instead of in valhaj-proxy
+	ServerTLSCAFile             = "./ca-cert.pem"        // CA certificates used to verify client certificates
+	ServerTLSCertFile           = "./server-cert.pem"
+	ServerTLSKeyFile            = "./server-key.pem"
+	ServerTLSClientAuth         = "require" // Client certificates: "none", "optional" (verified if presented) or "require"
+	ServerHandshakeTimeout      = 5000      // For the PROXY protocol header and the TLS handshake
+	ServerTLSReloadInterval     = 10000     // Checks the certificate files for changes, they're also reloaded on SIGHUP
+	/* internal/reader */
+	ReaderMaxArguments   = 1 << 20 // Of a request
+	ReaderMaxBulkLength  = 1 << 29 // Of an argument of a length-prefixed request (protocol 2), 512MB
+	ReaderMaxLineLength  = 1 << 26 // Of a line-based request (protocol 1), 64MB. Larger values need protocol 2
+	ReaderRequestTimeout = 10000   // Once a request started, the client may pause for at most this long, the session is closed otherwise
+	/* internal/writer */
+	WriterBufferSize = 1 << 16 // Replies are flushed once the pipelined requests were executed or the buffer is full
+	/* internal/auth */
+	AuthACLFile          = "users.acl" // Users that may authenticate and their permissions, see cmd/passwd. Authentication is disabled if the file doesn't exist
+	AuthCertificateUsers = true        // Authenticates TLS clients as the user named by the CN or a SAN of their verified certificate
+	AuthFailureDelay     = 1000        // Delays the reply to a failed authentication, so passwords can't be guessed quickly
+	AuthMaxFailures      = 5           // Failed authentications after which the session is closed, 0 for no limit
 	/* internal/storage */
 	StorageBasename  = "data"
 	StorageExtension = ".vdb"
 	/* internal/memory */
-	MemoryCacheContainerSize = 3
-	MemoryCacheShardCount    = 50
+	MemoryCacheContainerSize = 3            // Databases created at startup, named "0", "1", etc.
+	MemoryDatabaseLimit      = 16           // Maximum number of databases, including the ones created at startup
+	MemoryDefaultDatabase    = "0"          // Selected by new sessions, can't be dropped
+	MemoryCacheShardCount    = 64           // Rounded up to a power of two
+	MemoryMaxBytes           = 0            // Memory limit for all databases, 0 disables the limit
+	MemoryEvictionPolicy     = "noeviction" // One of "noeviction", "allkeys-lru", "allkeys-lfu", "allkeys-random", "volatile-lru", "volatile-lfu", "volatile-random" or "volatile-ttl"
+	MemoryEvictionSamples    = 5            // Number of keys sampled per eviction by the approximated policies
 )
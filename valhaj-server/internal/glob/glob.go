@@ -0,0 +1,85 @@
+package glob
+
+// Match(): Reports whether the name matches the glob-style pattern. Supports '*', '?', '[...]' classes (with ranges and '^' negation) and '\' escapes.
+func Match(pattern, name string) bool {
+	var p, n int
+	starP, starN := -1, -1 // Position of the last '*' and the name offset it currently covers
+
+	for n < len(name) {
+		if p < len(pattern) {
+			switch pattern[p] {
+			case '*':
+				starP, starN = p, n
+				p++
+				continue
+			case '?':
+				p++
+				n++
+				continue
+			case '[':
+				if next, ok := matchClass(pattern, p, name[n]); ok {
+					p = next
+					n++
+					continue
+				}
+			case '\\':
+				if p+1 < len(pattern) && pattern[p+1] == name[n] {
+					p += 2
+					n++
+					continue
+				}
+			default:
+				if pattern[p] == name[n] {
+					p++
+					n++
+					continue
+				}
+			}
+		}
+		if starP == -1 { // Mismatch and nothing to backtrack to
+			return false
+		}
+		starN++
+		p, n = starP+1, starN
+	}
+
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// matchClass(): Matches a single character against the class starting at pattern[start]. Returns the position following the class.
+func matchClass(pattern string, start int, c byte) (int, bool) {
+	p := start + 1
+	negate := false
+	if p < len(pattern) && (pattern[p] == '^' || pattern[p] == '!') {
+		negate = true
+		p++
+	}
+
+	matched := false
+	for first := true; p < len(pattern) && (first || pattern[p] != ']'); first = false {
+		lo := pattern[p]
+		if lo == '\\' && p+1 < len(pattern) {
+			p++
+			lo = pattern[p]
+		}
+		hi := lo
+		if p+2 < len(pattern) && pattern[p+1] == '-' && pattern[p+2] != ']' {
+			hi = pattern[p+2]
+			p += 2
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+		}
+		if lo <= c && c <= hi {
+			matched = true
+		}
+		p++
+	}
+	if p >= len(pattern) { // Unterminated class
+		return start, false
+	}
+	return p + 1, matched != negate
+}
@@ -0,0 +1,63 @@
+package glob
+
+import "testing"
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{"", "", true},
+		{"", "a", false},
+		{"key", "key", true},
+		{"key", "keys", false},
+		{"*", "", true},
+		{"*", "anything", true},
+		{"user:*", "user:1", true},
+		{"user:*", "session:1", false},
+		{"*:*:*", "a:b:c", true},
+		{"*:*:*", "a:b", false},
+		{"a*b*c", "axxbyyc", true},
+		{"a*b*c", "axxbyy", false},
+		{"a**", "a", true},
+		{"?", "a", true},
+		{"?", "", false},
+		{"k?y", "key", true},
+		{"k?y", "ky", false},
+		{"[abc]", "b", true},
+		{"[abc]", "d", false},
+		{"[a-c]", "b", true},
+		{"[a-c]", "d", false},
+		{"[c-a]", "b", true}, // Reversed ranges are swapped
+		{"[0-9a-f]x", "ex", true},
+		{"[^abc]", "d", true},
+		{"[^abc]", "a", false},
+		{"[!abc]", "d", true},
+		{"[^a-c]", "b", false},
+		{"[^a-c]*", "xyz", true},
+		{"[]]", "]", true}, // A leading ']' is part of the class
+		{"[a-]", "-", true},
+		{"[\\]]", "]", true},
+		{"[\\-]", "-", true},
+		{"[\\^]", "^", true},
+		{"\\*", "*", true},
+		{"\\*", "a", false},
+		{"\\?", "?", true},
+		{"\\[a]", "[a]", true},
+		{"\\a", "a", true},
+		{"a\\", "a\\", false}, // A trailing '\' escapes nothing and never matches
+		{"a\\", "a", false},
+		{"[", "[", false}, // An unterminated class never matches
+		{"[abc", "a", false},
+		{"[abc", "[abc", false},
+		{"*[", "x[", false},
+		{"[^", "a", false},
+		{"*\\", "x\\", false},
+	}
+	for _, test := range tests {
+		if got := Match(test.pattern, test.name); got != test.want {
+			t.Errorf("pattern '%s', name '%s': got %v, want %v", test.pattern, test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package hyperloglog
+
+import (
+	"errors"
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"strings"
+)
+
+var (
+	errInvalidSketch = errors.New("value is not a valid hyperloglog")
+
+	// Empty is the encoded form of a sketch without any registers set.
+	Empty = New().Encode()
+)
+
+const (
+	precision     = 14                    // Standard error of 1.04/sqrt(2^14), roughly 0.81%
+	registerCount = 1 << precision        // 16384 registers
+	registerMask  = registerCount - 1     // Selects the register index from the hash
+	rankSentinel  = 1 << (64 - precision) // Caps the rank at 64-precision+1, so it always fits into 6 bits
+
+	alphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/" // One character per 6 bit value
+
+	header             = "HYLL"             // Dense: one character per register, 16KB
+	sparseHeader       = "HYLS"             // Sparse: only the registers that are set
+	sparseEntry        = 4                  // Characters per set register, three for its 14 bit index and one for its rank
+	sparseMaxRegisters = registerCount / 16 // Up to 4KB, sketches with more registers set are encoded dense
+)
+
+var decoding = func() [256]int8 {
+	var table [256]int8
+	for i := range table {
+		table[i] = -1
+	}
+	for i := 0; i < len(alphabet); i++ {
+		table[alphabet[i]] = int8(i)
+	}
+	return table
+}()
+
+// Sketch contains the registers of a dense HyperLogLog.
+type Sketch []uint8
+
+// New(): Returns a new, empty sketch.
+func New() Sketch {
+	return make(Sketch, registerCount)
+}
+
+// Decode(): Parses a sketch from its string representation as stored in the database, either dense or sparse.
+func Decode(value string) (Sketch, error) {
+	if strings.HasPrefix(value, sparseHeader) {
+		return decodeSparse(value[len(sparseHeader):])
+	}
+	if len(value) != len(header)+registerCount || !strings.HasPrefix(value, header) {
+		return nil, errInvalidSketch
+	}
+
+	sketch := New()
+	for i := 0; i < registerCount; i++ {
+		register := decoding[value[len(header)+i]]
+		if register < 0 {
+			return nil, errInvalidSketch
+		}
+		sketch[i] = uint8(register)
+	}
+	return sketch, nil
+}
+
+// decodeSparse(): Parses the entries of a sparse sketch, their indexes must be strictly increasing.
+func decodeSparse(entries string) (Sketch, error) {
+	if len(entries)%sparseEntry != 0 || len(entries)/sparseEntry > sparseMaxRegisters {
+		return nil, errInvalidSketch
+	}
+
+	sketch := New()
+	previous := -1
+	for i := 0; i < len(entries); i += sparseEntry {
+		index := 0
+		for _, c := range []byte(entries[i : i+3]) {
+			digit := decoding[c]
+			if digit < 0 {
+				return nil, errInvalidSketch
+			}
+			index = index<<6 | int(digit)
+		}
+		rank := decoding[entries[i+3]]
+		if index >= registerCount || index <= previous || rank <= 0 {
+			return nil, errInvalidSketch
+		}
+		sketch[index] = uint8(rank)
+		previous = index
+	}
+	return sketch, nil
+}
+
+// Encode(): Returns the string representation of the sketch. It is printable, thus safe for snapshots and responses.
+// Sketches with few registers set are encoded sparse, so a small HyperLogLog takes a few bytes instead of 16KB.
+func (hll Sketch) Encode() string {
+	set := 0
+	for _, register := range hll {
+		if register != 0 {
+			set++
+		}
+	}
+	if set <= sparseMaxRegisters {
+		return hll.encodeSparse(set)
+	}
+
+	var sb strings.Builder
+	sb.Grow(len(header) + registerCount)
+	sb.WriteString(header)
+	for _, register := range hll {
+		sb.WriteByte(alphabet[register])
+	}
+	return sb.String()
+}
+
+// encodeSparse(): Encodes the set registers in order of their index.
+func (hll Sketch) encodeSparse(set int) string {
+	var sb strings.Builder
+	sb.Grow(len(sparseHeader) + set*sparseEntry)
+	sb.WriteString(sparseHeader)
+	for index, register := range hll {
+		if register != 0 {
+			sb.WriteByte(alphabet[index>>12])
+			sb.WriteByte(alphabet[index>>6&63])
+			sb.WriteByte(alphabet[index&63])
+			sb.WriteByte(alphabet[register])
+		}
+	}
+	return sb.String()
+}
+
+// Add(): Adds an element to the sketch. Returns true if a register was altered.
+func (hll Sketch) Add(element string) bool {
+	hash := hashElement(element)
+	index := hash & registerMask
+	rank := uint8(bits.TrailingZeros64((hash>>precision)|rankSentinel) + 1)
+	if rank > hll[index] {
+		hll[index] = rank
+		return true
+	}
+	return false
+}
+
+// Merge(): Merges another sketch into the sketch, resulting in the union of both.
+func (hll Sketch) Merge(other Sketch) {
+	for i, register := range other {
+		if register > hll[i] {
+			hll[i] = register
+		}
+	}
+}
+
+// Count(): Returns the estimated cardinality of the sketch.
+func (hll Sketch) Count() uint64 {
+	var sum float64
+	var zeros int
+	for _, register := range hll {
+		sum += 1 / float64(uint64(1)<<register)
+		if register == 0 {
+			zeros++
+		}
+	}
+
+	m := float64(registerCount)
+	alpha := 0.7213 / (1 + 1.079/m)
+	estimate := alpha * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 { // Small range correction (linear counting)
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return uint64(estimate + 0.5)
+}
+
+// hashElement(): Hashes an element with FNV-1a and a final avalanche step, so that similar elements spread evenly.
+func hashElement(element string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(element))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
@@ -0,0 +1,59 @@
+package hyperloglog
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestEncode(t *testing.T) {
+	tests := []struct {
+		name     string
+		elements int
+		prefix   string
+	}{
+		{"empty", 0, sparseHeader},
+		{"sparse", 100, sparseHeader},
+		{"dense", 10000, header},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sketch := New()
+			for i := 0; i < test.elements; i++ {
+				sketch.Add(strconv.Itoa(i))
+			}
+			encoded := sketch.Encode()
+			if !strings.HasPrefix(encoded, test.prefix) {
+				t.Fatalf("got encoding '%.4s', want '%s'", encoded, test.prefix)
+			}
+			decoded, err := Decode(encoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if decoded.Encode() != encoded || decoded.Count() != sketch.Count() {
+				t.Fatal("decoded sketch differs")
+			}
+		})
+	}
+	if Empty != sparseHeader {
+		t.Fatalf("got '%s' for an empty sketch, want '%s'", Empty, sparseHeader)
+	}
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	for _, value := range []string{
+		"",
+		"HYLL",
+		"HYLSAAB",      // Incomplete entry
+		"HYLSAAA*",     // Invalid character
+		"HYLSAABA",     // Rank 0
+		"HYLS/AAB",     // Index out of range
+		"HYLSAACBAABB", // Decreasing index
+		"HYLSAABBAABB", // Repeated index
+		"HYLL" + strings.Repeat("A", registerCount-1),
+	} {
+		if _, err := Decode(value); err != errInvalidSketch {
+			t.Errorf("value '%.16s': got error %v, want %v", value, err, errInvalidSketch)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package memory
+
+import (
+	"math/rand"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"lj.com/valhaj/internal/config"
+)
+
+var (
+	usedMemory  atomic.Int64  // Approximate memory usage of all databases in bytes
+	evictedKeys atomic.Uint64 // Number of keys evicted due to the memory limit
+)
+
+const (
+	entryOverhead = 96 // Approximate cost of the map slot, entry and string headers per key
+
+	lfuInitialFrequency = 5 // New keys start with a few hits, so they aren't evicted right away
+	lfuLogFactor        = 10
+	lfuDecayPeriod      = time.Minute
+	lfuMaxFrequency     = 255
+)
+
+// entrySize(): Returns the approximate memory usage of a key value pair.
+func entrySize(key, value string) int {
+	return len(key) + len(value) + entryOverhead
+}
+
+// touch(): Updates the access time and the logarithmic frequency counter of the entry.
+func (item *entry) touch() {
+	now := time.Now().UnixNano()
+	freq := item.frequency(now)
+	if freq < lfuMaxFrequency {
+		base := float64(max(int(freq)-lfuInitialFrequency, 0))
+		if rand.Float64() < 1/(base*lfuLogFactor+1) {
+			freq++
+		}
+	}
+	item.freq.Store(freq)
+	item.access.Store(now)
+}
+
+// frequency(): Returns the frequency counter of the entry, decayed by one for every period it hasn't been accessed.
+func (item *entry) frequency(now int64) uint32 {
+	freq := item.freq.Load()
+	periods := uint32(time.Duration(now-item.access.Load()) / lfuDecayPeriod)
+	if periods >= freq {
+		return 0
+	}
+	return freq - periods
+}
+
+// UsedMemory(): Returns the approximate memory usage of all databases in bytes.
+func UsedMemory() int64 {
+	return usedMemory.Load()
+}
+
+// EvictedKeys(): Returns the number of keys evicted due to the memory limit.
+func EvictedKeys() uint64 {
+	return evictedKeys.Load()
+}
+
+// FreeMemory(): Evicts keys according to the eviction policy until the memory usage is within the limit. Returns false if that's not possible.
+func (cc CacheContainer) FreeMemory() bool {
+	return cc.freeMemory(int64(config.MemoryMaxBytes), config.MemoryEvictionPolicy)
+}
+
+// freeMemory(): Evicts keys according to the policy until the memory usage is within the limit, 0 disables the limit.
+func (cc CacheContainer) freeMemory(limit int64, policy string) bool {
+	if limit <= 0 {
+		return true
+	}
+
+	for usedMemory.Load() > limit {
+		if policy == "noeviction" || !cc.evict(policy) {
+			return false
+		}
+	}
+	return true
+}
+
+// evict(): Evicts a single key, chosen among keys sampled from random shards. Returns false if there are no candidates.
+func (cc CacheContainer) evict(policy string) bool {
+	var best candidate
+	now := time.Now().UnixNano()
+	databases := cc.all()
+	samples := 0
+	for attempts := 0; samples < config.MemoryEvictionSamples && attempts < config.MemoryEvictionSamples*8; attempts++ {
+		shards := databases[rand.Intn(len(databases))].allShards()
+		if shards[rand.Intn(len(shards))].sample(policy, now, &best) {
+			samples++
+		}
+	}
+
+	// Sparse keyspaces may not yield any samples, so we'll walk the shards until we find a candidate
+	dbOffset := rand.Intn(len(databases))
+	for i := 0; i < len(databases) && best.shard == nil; i++ {
+		shards := databases[(dbOffset+i)%len(databases)].allShards()
+		shardOffset := rand.Intn(len(shards))
+		for j := 0; j < len(shards) && best.shard == nil; j++ {
+			shards[(shardOffset+j)%len(shards)].sample(policy, now, &best)
+		}
+	}
+	if best.shard == nil {
+		return false
+	}
+
+	best.shard.lock()
+	_, ok := best.shard.remove(best.key)
+	best.shard.Unlock()
+	if ok {
+		evictedKeys.Add(1)
+	}
+	return true
+}
+
+// candidate contains the key that is evicted next, lower scores are evicted first.
+type candidate struct {
+	shard *shard
+	key   string
+	score int64
+}
+
+// sample(): Considers a random key of the shard as eviction candidate, replacing the current candidate if its score is lower. Returns false if the shard is empty.
+func (s *shard) sample(policy string, now int64, best *candidate) bool {
+	s.rlock()
+	defer s.RUnlock()
+
+	// Map iteration starts at a random position, which makes for cheap sampling
+	var key string
+	var deadline time.Time
+	found := false
+	if strings.HasPrefix(policy, "volatile-") { // Only keys with a TTL are candidates
+		for key, deadline = range s.e {
+			found = true
+			break
+		}
+	} else {
+		for key = range s.m {
+			found = true
+			break
+		}
+	}
+	item, ok := s.m[key]
+	if !found || !ok {
+		return false
+	}
+
+	var score int64
+	switch policy {
+	case "allkeys-lru", "volatile-lru":
+		score = item.access.Load()
+	case "allkeys-lfu", "volatile-lfu":
+		score = int64(item.frequency(now))
+	case "volatile-ttl":
+		score = deadline.UnixNano()
+	}
+	if best.shard == nil || score < best.score {
+		*best = candidate{shard: s, key: key, score: score}
+	}
+	return true
+}
@@ -0,0 +1,133 @@
+package memory
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fillContainer(): Returns a container with keys without a TTL ('persistent:<i>') and with one ('volatile:<i>'), spread over two databases.
+func fillContainer(t *testing.T, count int) CacheContainer {
+	t.Helper()
+	cc := NewCacheContainer(2, 4)
+	for i := 0; i < count; i++ {
+		database := cc[strconv.Itoa(i%2)]
+		database.Store("persistent:"+strconv.Itoa(i), "value")
+		database.Store("volatile:"+strconv.Itoa(i), "value")
+		if !database.Expire("volatile:"+strconv.Itoa(i), time.Now().Add(time.Duration(i+1)*time.Hour)) {
+			t.Fatal("deadline wasn't set")
+		}
+	}
+	return cc
+}
+
+// countKeys(): Counts the keys of the container starting with the prefix.
+func countKeys(cc CacheContainer, prefix string) int {
+	count := 0
+	for _, database := range cc {
+		for _, key := range database.Keys() {
+			if strings.HasPrefix(key, prefix) {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+func TestEvictionPolicies(t *testing.T) {
+	const count = 20
+	keySize := int64(entrySize("volatile:10", "value"))
+	for _, policy := range []string{"allkeys-lru", "allkeys-lfu", "allkeys-random", "volatile-lru", "volatile-lfu", "volatile-random", "volatile-ttl"} {
+		t.Run(policy, func(t *testing.T) {
+			baseline := UsedMemory()
+			cc := fillContainer(t, count)
+			defer cc.ClearAll()
+			evicted := EvictedKeys()
+
+			// Freeing the size of 5 keys evicts at least 5 of them
+			if !cc.freeMemory(UsedMemory()-5*keySize, policy) {
+				t.Fatal("no memory was freed")
+			}
+			if got := countKeys(cc, "persistent:") + countKeys(cc, "volatile:"); got > 2*count-5 {
+				t.Fatalf("got %d keys left, want at most %d", got, 2*count-5)
+			}
+			if EvictedKeys()-evicted < 5 {
+				t.Fatalf("got %d evicted keys, want at least 5", EvictedKeys()-evicted)
+			}
+
+			// Freeing all memory evicts every eligible key, a limit of 0 would disable it
+			ok := cc.freeMemory(baseline+1, policy)
+			if strings.HasPrefix(policy, "volatile-") {
+				if ok {
+					t.Fatal("memory was freed although keys without a TTL are left")
+				}
+				if got := countKeys(cc, "persistent:"); got != count {
+					t.Fatalf("got %d keys without a TTL, want %d, only keys with a TTL are eligible", got, count)
+				}
+			} else if !ok {
+				t.Fatal("memory wasn't freed")
+			}
+			if got := countKeys(cc, "volatile:"); got != 0 {
+				t.Fatalf("got %d keys with a TTL left, want none", got)
+			}
+		})
+	}
+}
+
+func TestNoEviction(t *testing.T) {
+	cc := fillContainer(t, 10)
+	defer cc.ClearAll()
+	if cc.freeMemory(UsedMemory()-1, "noeviction") {
+		t.Fatal("memory was freed without eviction")
+	}
+	if got := countKeys(cc, ""); got != 20 {
+		t.Fatalf("got %d keys, want 20", got)
+	}
+	if !cc.freeMemory(0, "noeviction") { // No limit
+		t.Fatal("memory wasn't sufficient without a limit")
+	}
+}
+
+func TestMemoryAccounting(t *testing.T) {
+	baseline := UsedMemory()
+	database := NewShardedCache(4)
+	size := func() int64 {
+		var total int64
+		for _, shard := range database.allShards() {
+			total += shard.size
+		}
+		return total
+	}
+
+	database.Store("a", "value")
+	database.Store("b", "value")
+	database.Store("a", "longer value") // Overwriting accounts for the difference
+	database.LoadModifyStore("c", func(v string) (string, bool) { return v + "xyz", true }, "")
+	database.LoadModifyStore("c", func(v string) (string, bool) { return "", false }, "") // Failed modifications don't change anything
+	database.Delete("b")
+	database.LoadAndDelete("missing")
+	want := int64(entrySize("a", "longer value") + entrySize("c", "xyz"))
+	if got := size(); got != want {
+		t.Fatalf("got %d bytes accounted in the shards, want %d", got, want)
+	}
+	if got := UsedMemory() - baseline; got != want {
+		t.Fatalf("got %d bytes of used memory, want %d", got, want)
+	}
+
+	database.Reshard(8) // Migrated entries keep their size
+	for database.ShardCount() != 8 {
+		time.Sleep(time.Millisecond)
+	}
+	if got := size(); got != want {
+		t.Fatalf("got %d bytes accounted after resharding, want %d", got, want)
+	}
+
+	database.Clear()
+	if got := size(); got != 0 {
+		t.Fatalf("got %d bytes accounted after clearing, want 0", got)
+	}
+	if got := UsedMemory(); got != baseline {
+		t.Fatalf("got %d bytes of used memory after clearing, want %d", got, baseline)
+	}
+}
@@ -1,134 +1,453 @@
 package memory
 
 import (
-	"crypto/sha1"
+	"errors"
+	"hash/maphash"
+	"math/bits"
+	"math/rand"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"lj.com/valhaj/internal/config"
 )
 
 var (
-	Cache     ShardedCache
+	Cache     *ShardedCache
 	Container CacheContainer
+
+	containerLock sync.RWMutex // Guards the databases within the container, see Create(), Drop() and Swap()
+
+	errDatabaseExists  = errors.New("database already exists")
+	errDatabaseMissing = errors.New("no such database")
+	errDatabaseLimit   = errors.New("maximum number of databases reached")
+	errDatabaseName    = errors.New("invalid database name")
+	errDatabaseDefault = errors.New("the default database can't be dropped")
+
+	hashSeed = maphash.MakeSeed() // Random per process, so clients can't craft keys that pile up in a single shard
 )
 
+type entry struct {
+	value  string
+	access atomic.Int64  // Time of the last access in nanoseconds, used by the LRU policies
+	freq   atomic.Uint32 // Logarithmic access frequency counter, used by the LFU policies
+}
+
+// KeyInfo contains the metadata of a key, which is gathered without counting as an access.
+type KeyInfo struct {
+	Value     string
+	Size      int
+	Idle      time.Duration
+	Frequency uint32
+}
+
+// LockStats contains the lock metrics of a shard, which help to tune the number of shards.
+type LockStats struct {
+	Acquisitions uint64
+	Contentions  uint64        // Acquisitions that had to wait for another holder of the lock
+	WaitTime     time.Duration // Total time spent waiting for contended acquisitions
+}
+
 type shard struct {
 	sync.RWMutex
-	m map[string]string
+	m     map[string]*entry
+	e     map[string]time.Time // Expiration deadlines of keys with a TTL
+	size  int64                // Approximate memory usage of the entries in bytes
+	moved []*shard             // Layout the entries were migrated to while resharding, nil if the shard is still in use
+
+	acquisitions atomic.Uint64
+	contentions  atomic.Uint64
+	waitTime     atomic.Int64 // Nanoseconds
 }
 
-type ShardedCache []*shard
+// layout contains the shards of a database and, while resharding, the shards it is migrating to.
+type layout struct {
+	shards []*shard
+	target []*shard
+}
 
-func NewShardedCache(shardCount int) ShardedCache {
+type ShardedCache struct {
+	layout      atomic.Pointer[layout]
+	migrated    atomic.Int64 // Number of shards migrated by the running resharding
+	reshardLock sync.Mutex   // Held for the duration of a resharding
+}
+
+// NewShardedCache(): Returns a database with the given number of shards, rounded up to a power of two so shards can be selected by masking the hash.
+func NewShardedCache(shardCount int) *ShardedCache {
+	sc := &ShardedCache{}
+	sc.layout.Store(&layout{shards: newShards(shardCount)})
+	return sc
+}
+
+func newShards(shardCount int) []*shard {
+	if shardCount < 1 {
+		shardCount = 1
+	}
+	shardCount = 1 << bits.Len(uint(shardCount-1))
 	shards := make([]*shard, shardCount)
 
 	for i := 0; i < shardCount; i++ {
 		shards[i] = &shard{
-			m: make(map[string]string),
+			m: make(map[string]*entry),
+			e: make(map[string]time.Time),
 		}
 	}
 
 	return shards
 }
 
-type CacheContainer []*ShardedCache
+// CacheContainer maps the names of the logical databases to their caches.
+type CacheContainer map[string]*ShardedCache
 
+// NewCacheContainer(): Returns a container with the given number of databases, named "0", "1", etc.
 func NewCacheContainer(cacheCount, shardCount int) CacheContainer {
-	caches := make([]*ShardedCache, cacheCount)
+	caches := make(CacheContainer, cacheCount)
 
 	for i := 0; i < cacheCount; i++ {
-		cache := NewShardedCache(shardCount)
-		caches[i] = &cache
+		caches[strconv.Itoa(i)] = NewShardedCache(shardCount)
 	}
 
 	return caches
 }
 
+// ValidName(): Reports whether the name may be used for a database. Names end up in snapshot filenames, so only letters, digits, '-' and '_' are allowed.
+func ValidName(name string) bool {
+	if len(name) == 0 || len(name) > 64 {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+func (cc CacheContainer) Load(name string) (*ShardedCache, bool) {
+	containerLock.RLock()
+	defer containerLock.RUnlock()
+
+	database, ok := cc[name]
+	return database, ok
+}
+
+// Names(): Returns the names of all databases in lexical order.
+func (cc CacheContainer) Names() []string {
+	containerLock.RLock()
+	defer containerLock.RUnlock()
+
+	names := make([]string, 0, len(cc))
+	for name := range cc {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func (cc CacheContainer) all() []*ShardedCache {
+	containerLock.RLock()
+	defer containerLock.RUnlock()
+
+	databases := make([]*ShardedCache, 0, len(cc))
+	for _, database := range cc {
+		databases = append(databases, database)
+	}
+	return databases
+}
+
+// ClearAll(): Deletes the keys of every database concurrently. The databases are taken under a single read lock, so a concurrent Drop() can't leave one missing.
+func (cc CacheContainer) ClearAll() {
+	var wg sync.WaitGroup
+	databases := cc.all()
+	wg.Add(len(databases))
+	for _, database := range databases {
+		go func(database *ShardedCache) {
+			defer wg.Done()
+			database.Clear()
+		}(database)
+	}
+	wg.Wait()
+}
+
+func (cc CacheContainer) Create(name string) (*ShardedCache, error) {
+	if !ValidName(name) {
+		return nil, errDatabaseName
+	}
+
+	containerLock.Lock()
+	defer containerLock.Unlock()
+
+	if _, ok := cc[name]; ok {
+		return nil, errDatabaseExists
+	}
+	if len(cc) >= config.MemoryDatabaseLimit {
+		return nil, errDatabaseLimit
+	}
+	database := NewShardedCache(config.MemoryCacheShardCount)
+	cc[name] = database
+	return database, nil
+}
+
+// Drop(): Removes the database and deletes its keys. Sessions that selected it can't use it anymore.
+func (cc CacheContainer) Drop(name string) error {
+	if name == config.MemoryDefaultDatabase {
+		return errDatabaseDefault
+	}
+
+	containerLock.Lock()
+	database, ok := cc[name]
+	delete(cc, name)
+	containerLock.Unlock()
+
+	if !ok {
+		return errDatabaseMissing
+	}
+	database.Clear()
+	return nil
+}
+
+func (cc CacheContainer) Swap(a, b string) error {
+	containerLock.Lock()
+	defer containerLock.Unlock()
+
+	databaseA, okA := cc[a]
+	databaseB, okB := cc[b]
+	if !okA || !okB {
+		return errDatabaseMissing
+	}
+	cc[a], cc[b] = databaseB, databaseA
+	return nil
+}
+
 /* shard ops */
 
-func (sc ShardedCache) getShardIndex(key string) int {
-	checksum := sha1.Sum([]byte(key))
-	hash := int(checksum[17])
-	return hash % len(sc)
+// lockShard(): Returns the write-locked shard holding the key, following the migrations of a resharding.
+func (sc *ShardedCache) lockShard(key string) *shard {
+	hash := maphash.String(hashSeed, key)
+	shards := sc.layout.Load().shards
+	for {
+		shard := shards[hash&uint64(len(shards)-1)]
+		shard.lock()
+		if shard.moved == nil {
+			return shard
+		}
+		shards = shard.moved
+		shard.Unlock()
+	}
+}
+
+// rlockShard(): Returns the read-locked shard holding the key, following the migrations of a resharding.
+func (sc *ShardedCache) rlockShard(key string) *shard {
+	hash := maphash.String(hashSeed, key)
+	shards := sc.layout.Load().shards
+	for {
+		shard := shards[hash&uint64(len(shards)-1)]
+		shard.rlock()
+		if shard.moved == nil {
+			return shard
+		}
+		shards = shard.moved
+		shard.RUnlock()
+	}
 }
 
-func (sc ShardedCache) getShard(key string) *shard {
-	index := sc.getShardIndex(key)
-	return sc[index]
+// allShards(): Returns the shards of the current layout, followed by the shards of the target layout while resharding.
+func (sc *ShardedCache) allShards() []*shard {
+	current := sc.layout.Load()
+	if current.target == nil {
+		return current.shards
+	}
+	return append(current.shards[:len(current.shards):len(current.shards)], current.target...)
+}
+
+// lock(): Acquires the write lock, measuring the wait time if the lock is held by someone else.
+func (s *shard) lock() {
+	s.acquisitions.Add(1)
+	if s.TryLock() {
+		return
+	}
+	start := time.Now()
+	s.Lock()
+	s.contentions.Add(1)
+	s.waitTime.Add(int64(time.Since(start)))
+}
+
+// rlock(): Acquires the read lock, measuring the wait time if a writer holds or waits for the lock.
+func (s *shard) rlock() {
+	s.acquisitions.Add(1)
+	if s.TryRLock() {
+		return
+	}
+	start := time.Now()
+	s.RLock()
+	s.contentions.Add(1)
+	s.waitTime.Add(int64(time.Since(start)))
+}
+
+// store(): Stores copies of the key and the value. Arguments are substrings of their request, keeping them would keep the whole request in memory,
+// which the memory usage wouldn't account for. Overwriting a value removes its deadline, unless the value was modified (e.g. incremented).
+func (s *shard) store(key, value string, modified bool) {
+	value = strings.Clone(value)
+	if item, ok := s.m[key]; ok {
+		if !modified {
+			delete(s.e, key)
+		}
+		s.resize(len(value) - len(item.value))
+		item.value = value
+		item.touch()
+		return
+	}
+
+	item := &entry{value: value}
+	item.access.Store(time.Now().UnixNano())
+	item.freq.Store(lfuInitialFrequency)
+	s.m[strings.Clone(key)] = item
+	s.resize(entrySize(key, value))
+}
+
+func (s *shard) remove(key string) (string, bool) {
+	item, ok := s.m[key]
+	if !ok {
+		return "", false
+	}
+	delete(s.m, key)
+	delete(s.e, key)
+	s.resize(-entrySize(key, item.value))
+	return item.value, true
+}
+
+func (s *shard) resize(delta int) {
+	s.size += int64(delta)
+	usedMemory.Add(int64(delta))
 }
 
 /* map ops */
 
-func (sc ShardedCache) Load(key string) (string, bool) {
-	shard := sc.getShard(key)
-	shard.RLock()
+func (sc *ShardedCache) Load(key string) (string, bool) {
+	shard := sc.rlockShard(key)
 	defer shard.RUnlock()
 
-	value, ok := shard.m[key]
-	return value, ok
+	item, ok := shard.m[key]
+	if !ok {
+		return "", false
+	}
+	item.touch()
+	return item.value, true
 }
 
-func (sc ShardedCache) LoadAndDelete(key string) (string, bool) {
-	shard := sc.getShard(key)
-	shard.Lock()
+func (sc *ShardedCache) LoadAndDelete(key string) (string, bool) {
+	shard := sc.lockShard(key)
 	defer shard.Unlock()
 
-	value, ok := shard.m[key]
-	if ok {
-		delete(shard.m, key)
-	}
-	return value, ok
+	return shard.remove(key)
 }
 
-func (sc ShardedCache) LoadExistStore(key, value string, exists, overwrite bool) (string, bool) {
-	shard := sc.getShard(key)
-	shard.Lock()
+func (sc *ShardedCache) LoadExistStore(key, value string, exists, overwrite bool) (string, bool) {
+	shard := sc.lockShard(key)
 	defer shard.Unlock()
 
-	oldValue, ok := shard.m[key]
+	var oldValue string
+	item, ok := shard.m[key]
+	if ok {
+		oldValue = item.value
+	}
 	if ok == exists || overwrite {
-		shard.m[key] = value
+		shard.store(key, value, false)
 	}
 	return oldValue, ok
 }
 
-func (sc ShardedCache) LoadModifyStore(key string, modifier func(string) (string, bool), initial string) (string, bool) {
-	shard := sc.getShard(key)
-	shard.Lock()
+func (sc *ShardedCache) LoadModifyStore(key string, modifier func(string) (string, bool), initial string) (string, bool) {
+	return sc.ModifyStore(key, func(value string, exists bool) (string, bool) {
+		if !exists {
+			value = initial
+		}
+		return modifier(value)
+	})
+}
+
+// ModifyStore(): Like LoadModifyStore(), but tells the modifier whether the key exists, e.g. to tell a created key apart from an unchanged one.
+func (sc *ShardedCache) ModifyStore(key string, modifier func(value string, exists bool) (string, bool)) (string, bool) {
+	shard := sc.lockShard(key)
 	defer shard.Unlock()
 
-	value, ok := shard.m[key]
-	if !ok {
-		value = initial
+	var value string
+	item, exists := shard.m[key]
+	if exists {
+		value = item.value
+	}
+	value, ok := modifier(value, exists)
+	if ok { // A failed modification must neither change the value nor create the key
+		shard.store(key, value, true)
 	}
-	value, ok = modifier(value)
-	shard.m[key] = value
 	return value, ok
 }
 
-func (sc ShardedCache) Store(key, value string) {
-	shard := sc.getShard(key)
-	shard.Lock()
+func (sc *ShardedCache) Store(key, value string) {
+	shard := sc.lockShard(key)
 	defer shard.Unlock()
 
-	shard.m[key] = value
+	shard.store(key, value, false)
 }
 
-func (sc ShardedCache) Delete(key string) {
-	shard := sc.getShard(key)
-	shard.Lock()
+func (sc *ShardedCache) Delete(key string) {
+	shard := sc.lockShard(key)
 	defer shard.Unlock()
 
-	delete(shard.m, key)
+	shard.remove(key)
 }
 
-func (sc ShardedCache) Range() ([]string, int) {
+func (sc *ShardedCache) Expire(key string, deadline time.Time) bool {
+	shard := sc.lockShard(key)
+	defer shard.Unlock()
+
+	if _, ok := shard.m[key]; !ok {
+		return false
+	}
+	shard.e[strings.Clone(key)] = deadline // Assigning replaces the key of an existing deadline as well
+	return true
+}
+
+// DeleteExpired(): Deletes the key if it still expires at the deadline, it may have been overwritten or expire at another deadline meanwhile.
+func (sc *ShardedCache) DeleteExpired(key string, deadline time.Time) bool {
+	shard := sc.lockShard(key)
+	defer shard.Unlock()
+
+	if current, ok := shard.e[key]; !ok || !current.Equal(deadline) {
+		return false
+	}
+	shard.remove(key)
+	return true
+}
+
+func (sc *ShardedCache) Inspect(key string) (KeyInfo, bool) {
+	shard := sc.rlockShard(key)
+	defer shard.RUnlock()
+
+	item, ok := shard.m[key]
+	if !ok {
+		return KeyInfo{}, false
+	}
+	now := time.Now().UnixNano()
+	return KeyInfo{
+		Value:     item.value,
+		Size:      entrySize(key, item.value),
+		Idle:      time.Duration(now - item.access.Load()),
+		Frequency: item.frequency(now),
+	}, true
+}
+
+func (sc *ShardedCache) Range() ([]string, int) {
 	var items []string
 	var total int
-	for _, shard := range sc {
-		shard.Lock()
-		for key, value := range shard.m {
-			items = append(items, key, value)
+	for _, shard := range sc.allShards() {
+		shard.lock()
+		for key, item := range shard.m {
+			items = append(items, key, item.value)
 		}
 		shard.Unlock()
 	}
@@ -137,12 +456,13 @@ func (sc ShardedCache) Range() ([]string, int) {
 	return items, total
 }
 
-func (sc ShardedCache) Count() (int, []int) {
+func (sc *ShardedCache) Count() (int, []int) {
 	var total int
-	var subtotal = make([]int, 0, config.MemoryCacheShardCount)
+	var shards = sc.allShards()
+	var subtotal = make([]int, 0, len(shards))
 	var shardMapSize int
-	for _, shard := range sc {
-		shard.RLock()
+	for _, shard := range shards {
+		shard.rlock()
 		shardMapSize = len(shard.m)
 		shard.RUnlock()
 
@@ -153,11 +473,204 @@ func (sc ShardedCache) Count() (int, []int) {
 	return total, subtotal
 }
 
-func (sc ShardedCache) Clear() {
-	for _, shard := range sc {
-		shard.Lock()
+func (sc *ShardedCache) LockStats() []LockStats {
+	shards := sc.allShards()
+	stats := make([]LockStats, 0, len(shards))
+	for _, shard := range shards {
+		stats = append(stats, LockStats{
+			Acquisitions: shard.acquisitions.Load(),
+			Contentions:  shard.contentions.Load(),
+			WaitTime:     time.Duration(shard.waitTime.Load()),
+		})
+	}
+
+	return stats
+}
+
+func (sc *ShardedCache) CountExpiring() int {
+	var total int
+	for _, shard := range sc.allShards() {
+		shard.rlock()
+		total += len(shard.e)
+		shard.RUnlock()
+	}
+
+	return total
+}
+
+func (s *shard) keys() []string {
+	s.rlock()
+	defer s.RUnlock()
+
+	keys := make([]string, 0, len(s.m))
+	for key := range s.m {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Scan(): Returns the keys of the shard selected by the cursor and the cursor to continue with, which is 0 once all shards were visited.
+// The cursor is incremented in reverse bit order, so keys present during the entire scan are returned even if the database is resharded in between.
+func (sc *ShardedCache) Scan(cursor int) ([]string, int) {
+	current := sc.layout.Load()
+	small, large := current.shards, current.target
+	shrinking := large != nil && len(large) < len(small)
+	if shrinking {
+		small, large = large, small
+	}
+
+	v := uint64(cursor)
+	smallMask := uint64(len(small) - 1)
+	if large == nil {
+		keys := small[v&smallMask].keys()
+		v |= ^smallMask
+		v = bits.Reverse64(bits.Reverse64(v) + 1)
+		return keys, int(v)
+	}
+
+	// While resharding, the shard of the smaller layout comes with all shards of the larger layout it expands to.
+	// Keys only move from the current to the target layout, so the current shards are visited first to not miss keys migrated meanwhile.
+	var keys []string
+	if !shrinking {
+		keys = small[v&smallMask].keys()
+	}
+	largeMask := uint64(len(large) - 1)
+	for {
+		keys = append(keys, large[v&largeMask].keys()...)
+		v |= ^largeMask
+		v = bits.Reverse64(bits.Reverse64(v) + 1)
+		if v&(smallMask^largeMask) == 0 {
+			break
+		}
+	}
+	if shrinking {
+		keys = append(keys, small[uint64(cursor)&smallMask].keys()...)
+	}
+	return keys, int(v)
+}
+
+func (sc *ShardedCache) Keys() []string {
+	var keys []string
+	resharding := sc.layout.Load().target != nil
+	for _, shard := range sc.allShards() {
+		keys = append(keys, shard.keys()...)
+	}
+	if resharding { // Keys migrated while iterating may have been seen twice
+		slices.Sort(keys)
+		keys = slices.Compact(keys)
+	}
+	return keys
+}
+
+// RandomKey(): Returns a random key for which the match function returns true.
+func (sc *ShardedCache) RandomKey(match func(key string) bool) (string, bool) {
+	shards := sc.allShards()
+	offset := rand.Intn(len(shards))
+	for i := range shards {
+		shard := shards[(offset+i)%len(shards)]
+		shard.rlock()
+		var chosen string
+		matches := 0
+		for key := range shard.m { // Reservoir sampling, as only some keys may match
+			if match(key) {
+				matches++
+				if rand.Intn(matches) == 0 {
+					chosen = key
+				}
+			}
+		}
+		shard.RUnlock()
+		if matches > 0 {
+			return chosen, true
+		}
+	}
+	return "", false
+}
+
+func (sc *ShardedCache) Clear() {
+	for _, shard := range sc.allShards() {
+		shard.lock()
 		shard.m = nil
-		shard.m = make(map[string]string)
+		shard.m = make(map[string]*entry)
+		shard.e = make(map[string]time.Time)
+		shard.resize(int(-shard.size))
 		shard.Unlock()
 	}
 }
+
+/* resharding */
+
+func (sc *ShardedCache) ShardCount() int {
+	return len(sc.layout.Load().shards)
+}
+
+// ReshardProgress(): Returns the number of shards of the target layout and how many shards were migrated so far. The target is 0 unless resharding.
+func (sc *ShardedCache) ReshardProgress() (int, int) {
+	current := sc.layout.Load()
+	if current.target == nil {
+		return 0, 0
+	}
+	return len(current.target), int(sc.migrated.Load())
+}
+
+// Reshard(): Starts migrating the database to a new number of shards in the background, rounded up to a power of two. Returns false if a resharding is already in progress.
+func (sc *ShardedCache) Reshard(shardCount int) bool {
+	if !sc.reshardLock.TryLock() {
+		return false
+	}
+
+	shards := sc.layout.Load().shards
+	target := newShards(shardCount)
+	if len(target) == len(shards) {
+		sc.reshardLock.Unlock()
+		return true
+	}
+
+	sc.layout.Store(&layout{shards: shards, target: target})
+	go func() {
+		defer sc.reshardLock.Unlock()
+
+		// Shards are migrated one at a time, only keys of the shard being migrated are blocked meanwhile
+		for i, shard := range shards {
+			shard.migrate(target)
+			sc.migrated.Store(int64(i + 1))
+		}
+		sc.layout.Store(&layout{shards: target})
+		sc.migrated.Store(0)
+	}()
+	return true
+}
+
+// migrate(): Moves the entries of the shard to the target layout, future accesses to the shard are redirected there.
+func (s *shard) migrate(target []*shard) {
+	s.lock()
+	defer s.Unlock()
+
+	mask := uint64(len(target) - 1)
+	moves := make([][]string, len(target))
+	for key := range s.m {
+		index := maphash.String(hashSeed, key) & mask
+		moves[index] = append(moves[index], key)
+	}
+	for index, keys := range moves {
+		if len(keys) == 0 {
+			continue
+		}
+		t := target[index]
+		t.lock()
+		for _, key := range keys {
+			item := s.m[key]
+			t.m[key] = item
+			if deadline, ok := s.e[key]; ok {
+				t.e[key] = deadline
+			}
+			t.size += int64(entrySize(key, item.value)) // The total memory usage doesn't change
+		}
+		t.Unlock()
+	}
+
+	s.m = make(map[string]*entry)
+	s.e = make(map[string]time.Time)
+	s.size = 0
+	s.moved = target
+}
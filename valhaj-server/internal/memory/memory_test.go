@@ -0,0 +1,36 @@
+package memory
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestClearAll(t *testing.T) {
+	cc := NewCacheContainer(1, 4)
+	for i := 1; i < 16; i++ {
+		database, err := cc.Create("db" + strconv.Itoa(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		database.Store("key", "value")
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() { // Databases dropped while flushing must neither be missed nor crash the flush
+		defer wg.Done()
+		for i := 1; i < 16; i++ {
+			cc.Drop("db" + strconv.Itoa(i))
+		}
+	}()
+	cc.ClearAll()
+	wg.Wait()
+
+	for _, name := range cc.Names() {
+		database, _ := cc.Load(name)
+		if count, _ := database.Count(); count != 0 {
+			t.Fatalf("database '%s' still has %d keys", name, count)
+		}
+	}
+}
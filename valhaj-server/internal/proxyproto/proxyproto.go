@@ -0,0 +1,283 @@
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var (
+	signature   = []byte("\r\n\r\n\x00\r\nQUIT\n") // Starts every version 2 header
+	signatureV1 = []byte("PROXY")                  // Starts every version 1 header, which is human-readable
+
+	errInvalidSignature = errors.New("invalid PROXY protocol header signature")
+	errInvalidHeader    = errors.New("invalid PROXY protocol header")
+	errHeaderTooLong    = errors.New("PROXY protocol header exceeds the length limit")
+)
+
+const (
+	maxLineLength   = 107  // Of a version 1 header, including "\r\n"
+	headerLength    = 16   // Signature, version and command, address family and protocol, length of the remainder
+	maxHeaderLength = 4096 // Of the remainder: addresses and TLVs
+	commandLocal    = 0x0
+	commandProxy    = 0x1
+	familyInet      = 0x1
+	familyInet6     = 0x2
+	familyUnix      = 0x3
+	typeSSL         = 0x20 // TLV describing the client's TLS connection, containing sub-TLVs
+	subtypeSSLCN    = 0x22 // Common name of the client certificate
+	clientSSL       = 0x01 // Client connected over TLS
+	clientCertConn  = 0x02 // Client presented a certificate on this connection
+	clientCertSess  = 0x04 // Client presented a certificate during the TLS session
+)
+
+// Header contains the details about the client that the proxy forwards.
+type Header struct {
+	Source      net.Addr // Address of the client, nil for connections of the proxy itself (e.g. health checks)
+	Destination net.Addr
+	CommonName  string // Of the client certificate, only set if the proxy verified it (version 2 only)
+}
+
+// Sources are the trusted proxies, which must send a header (version 1 or 2) before anything else.
+type Sources struct {
+	networks []*net.IPNet
+}
+
+// ParseSources(): Parses a comma-separated list of trusted sources, either CIDRs (e.g. "10.0.0.0/8") or IP addresses.
+// UNIX socket clients can't be trusted by address, as any local process may connect, valhaj-proxy gets a listener of its own instead.
+func ParseSources(list string) (*Sources, error) {
+	sources := &Sources{}
+	for _, source := range strings.Split(list, ",") {
+		source = strings.TrimSpace(source)
+		switch {
+		case source == "":
+			continue
+		case strings.Contains(source, "/"):
+			_, network, err := net.ParseCIDR(source)
+			if err != nil {
+				return nil, err
+			}
+			sources.networks = append(sources.networks, network)
+		default:
+			ip := net.ParseIP(source)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted source '%s'", source)
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			sources.networks = append(sources.networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		}
+	}
+	return sources, nil
+}
+
+// Contains(): Reports whether the address belongs to a trusted source.
+func (s *Sources) Contains(addr net.Addr) bool {
+	if s == nil {
+		return false
+	}
+	if a, ok := addr.(*net.TCPAddr); ok {
+		for _, network := range s.networks {
+			if network.Contains(a.IP) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ReadHeader(): Reads a version 1 or 2 header. Reads exactly the length of the header, so no data following it is consumed.
+func ReadHeader(r io.Reader) (*Header, error) {
+	var prefix [headerLength]byte
+	if _, err := io.ReadFull(r, prefix[:len(signatureV1)]); err != nil {
+		return nil, err
+	}
+	if bytes.Equal(prefix[:len(signatureV1)], signatureV1) {
+		return readLine(r)
+	}
+	if !bytes.Equal(prefix[:len(signatureV1)], signature[:len(signatureV1)]) { // Fail early, e.g. if a command was sent instead
+		return nil, errInvalidSignature
+	}
+	if _, err := io.ReadFull(r, prefix[len(signatureV1):]); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(prefix[:len(signature)], signature) {
+		return nil, errInvalidSignature
+	}
+	if prefix[12]>>4 != 2 {
+		return nil, errInvalidHeader
+	}
+	length := int(binary.BigEndian.Uint16(prefix[14:16]))
+	if length > maxHeaderLength {
+		return nil, errHeaderTooLong
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	header := &Header{}
+	switch prefix[12] & 0x0f {
+	case commandLocal: // Sent by the proxy on its own behalf, the addresses are ignored
+		return header, nil
+	case commandProxy:
+	default:
+		return nil, errInvalidHeader
+	}
+
+	var offset int
+	switch prefix[13] >> 4 {
+	case familyInet:
+		if length < 12 {
+			return nil, errInvalidHeader
+		}
+		header.Source = &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}
+		header.Destination = &net.TCPAddr{IP: net.IP(payload[4:8]), Port: int(binary.BigEndian.Uint16(payload[10:12]))}
+		offset = 12
+	case familyInet6:
+		if length < 36 {
+			return nil, errInvalidHeader
+		}
+		header.Source = &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}
+		header.Destination = &net.TCPAddr{IP: net.IP(payload[16:32]), Port: int(binary.BigEndian.Uint16(payload[34:36]))}
+		offset = 36
+	case familyUnix:
+		if length < 216 {
+			return nil, errInvalidHeader
+		}
+		header.Source = &net.UnixAddr{Name: string(bytes.TrimRight(payload[0:108], "\x00")), Net: "unix"}
+		header.Destination = &net.UnixAddr{Name: string(bytes.TrimRight(payload[108:216], "\x00")), Net: "unix"}
+		offset = 216
+	default: // Unspecified, the addresses are unknown
+		offset = length
+	}
+
+	if err := header.parseTLVs(payload[offset:]); err != nil {
+		return nil, err
+	}
+	return header, nil
+}
+
+// readLine(): Reads the remainder of a version 1 header: ' <TCP4|TCP6> <source> <destination> <source port> <destination port>\r\n' or ' UNKNOWN ...\r\n'.
+func readLine(r io.Reader) (*Header, error) {
+	line := make([]byte, 0, maxLineLength)
+	var b [1]byte
+	for len(line) < maxLineLength-len(signatureV1) { // Byte by byte, as the header has no length prefix
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return nil, err
+		}
+		line = append(line, b[0])
+		if b[0] == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errHeaderTooLong
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) < 2 || fields[0] != "" {
+		return nil, errInvalidHeader
+	}
+	header := &Header{}
+	switch fields[1] {
+	case "UNKNOWN": // The addresses are unknown, anything following is ignored
+		return header, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, errInvalidHeader
+	}
+	if len(fields) != 6 {
+		return nil, errInvalidHeader
+	}
+	source, destination := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	sourcePort, sErr := strconv.ParseUint(fields[4], 10, 16)
+	destinationPort, dErr := strconv.ParseUint(fields[5], 10, 16)
+	if source == nil || destination == nil || sErr != nil || dErr != nil {
+		return nil, errInvalidHeader
+	}
+	if fields[1] == "TCP4" && (source.To4() == nil || destination.To4() == nil) {
+		return nil, errInvalidHeader
+	}
+	header.Source = &net.TCPAddr{IP: source, Port: int(sourcePort)}
+	header.Destination = &net.TCPAddr{IP: destination, Port: int(destinationPort)}
+	return header, nil
+}
+
+// Wrap(): Returns the connection, reporting the client's address as its remote address.
+func (h *Header) Wrap(conn net.Conn) net.Conn {
+	if h.Source == nil {
+		return conn
+	}
+	return &Conn{Conn: conn, source: h.Source}
+}
+
+// parseTLVs(): Picks the common name of a verified client certificate from the TLVs, others are skipped.
+func (h *Header) parseTLVs(tlvs []byte) error {
+	for len(tlvs) > 0 {
+		if len(tlvs) < 3 {
+			return errInvalidHeader
+		}
+		kind, length := tlvs[0], int(binary.BigEndian.Uint16(tlvs[1:3]))
+		if len(tlvs) < 3+length {
+			return errInvalidHeader
+		}
+		value := tlvs[3 : 3+length]
+		tlvs = tlvs[3+length:]
+		if kind != typeSSL {
+			continue
+		}
+
+		// Client flags, verification result (0 if the certificate was verified) and sub-TLVs
+		if len(value) < 5 {
+			return errInvalidHeader
+		}
+		client, verify := value[0], binary.BigEndian.Uint32(value[1:5])
+		verified := client&clientSSL != 0 && client&(clientCertConn|clientCertSess) != 0 && verify == 0
+		commonName, err := parseCommonName(value[5:])
+		if err != nil {
+			return err
+		}
+		if verified {
+			h.CommonName = commonName
+		}
+	}
+	return nil
+}
+
+// parseCommonName(): Returns the common name from the sub-TLVs of the SSL TLV, empty if there's none.
+func parseCommonName(tlvs []byte) (string, error) {
+	var commonName string
+	for len(tlvs) > 0 {
+		if len(tlvs) < 3 {
+			return "", errInvalidHeader
+		}
+		kind, length := tlvs[0], int(binary.BigEndian.Uint16(tlvs[1:3]))
+		if len(tlvs) < 3+length {
+			return "", errInvalidHeader
+		}
+		if kind == subtypeSSLCN {
+			commonName = string(tlvs[3 : 3+length])
+		}
+		tlvs = tlvs[3+length:]
+	}
+	return commonName, nil
+}
+
+// Conn reports the address of the client forwarded by the proxy as its remote address.
+type Conn struct {
+	net.Conn
+	source net.Addr
+}
+
+// RemoteAddr(): Returns the address of the client.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.source
+}
@@ -0,0 +1,148 @@
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// encodeV2(): Encodes a version 2 header with the given command, address family and payload (addresses and TLVs).
+func encodeV2(command, family byte, payload []byte) []byte {
+	b := append([]byte(nil), signature...)
+	b = append(b, 0x20|command, family<<4|0x1)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(payload)))
+	return append(b, payload...)
+}
+
+// encodeTLV(): Encodes a TLV of the given type.
+func encodeTLV(kind byte, value []byte) []byte {
+	b := binary.BigEndian.AppendUint16([]byte{kind}, uint16(len(value)))
+	return append(b, value...)
+}
+
+// encodeSSL(): Encodes an SSL TLV with the client flags, the verification result and a common name.
+func encodeSSL(client byte, verify uint32, commonName string) []byte {
+	value := binary.BigEndian.AppendUint32([]byte{client}, verify)
+	return encodeTLV(typeSSL, append(value, encodeTLV(subtypeSSLCN, []byte(commonName))...))
+}
+
+func TestReadHeader(t *testing.T) {
+	inet := []byte{10, 0, 0, 1, 10, 0, 0, 2, 0x30, 0x39, 0x1a, 0x0a} // 10.0.0.1:12345 to 10.0.0.2:6666
+	inet6 := make([]byte, 36)
+	inet6[15], inet6[31], inet6[33], inet6[35] = 1, 2, 80, 81
+	unix := make([]byte, 216)
+	copy(unix, "/run/client.sock")
+	verified := byte(clientSSL | clientCertConn)
+
+	tests := []struct {
+		name        string
+		data        []byte
+		source      string
+		destination string
+		commonName  string
+		err         error
+	}{
+		{"v1 tcp4", []byte("PROXY TCP4 10.0.0.1 10.0.0.2 12345 6666\r\n"), "10.0.0.1:12345", "10.0.0.2:6666", "", nil},
+		{"v1 tcp6", []byte("PROXY TCP6 ::1 ::2 12345 6666\r\n"), "[::1]:12345", "[::2]:6666", "", nil},
+		{"v1 unknown", []byte("PROXY UNKNOWN ignored\r\n"), "", "", "", nil},
+		{"v1 tcp4 with ipv6", []byte("PROXY TCP4 ::1 ::2 12345 6666\r\n"), "", "", "", errInvalidHeader},
+		{"v1 port", []byte("PROXY TCP4 10.0.0.1 10.0.0.2 123456 6666\r\n"), "", "", "", errInvalidHeader},
+		{"v1 fields", []byte("PROXY TCP4 10.0.0.1 10.0.0.2 12345\r\n"), "", "", "", errInvalidHeader},
+		{"v1 protocol", []byte("PROXY UDP4 10.0.0.1 10.0.0.2 12345 6666\r\n"), "", "", "", errInvalidHeader},
+		{"v1 too long", []byte("PROXY TCP4 " + strings.Repeat("1", 200) + "\r\n"), "", "", "", errHeaderTooLong},
+		{"v1 truncated", []byte("PROXY TCP4 10.0.0.1"), "", "", "", io.EOF},
+		{"v2 inet", encodeV2(commandProxy, familyInet, inet), "10.0.0.1:12345", "10.0.0.2:6666", "", nil},
+		{"v2 inet6", encodeV2(commandProxy, familyInet6, inet6), "[::1]:80", "[::2]:81", "", nil},
+		{"v2 unix", encodeV2(commandProxy, familyUnix, unix), "/run/client.sock", "", "", nil},
+		{"v2 unspecified", encodeV2(commandProxy, 0x0, []byte("ignored")), "", "", "", nil},
+		{"v2 local", encodeV2(commandLocal, familyInet, inet), "", "", "", nil},
+		{"v2 command", encodeV2(0x2, familyInet, inet), "", "", "", errInvalidHeader},
+		{"v2 version", append(append(append([]byte(nil), signature...), 0x11, 0x11), 0, 0), "", "", "", errInvalidHeader},
+		{"v2 signature", append([]byte("\r\n\r\n\x00\r\nQUIX\n"), 0x21, 0x11, 0, 0), "", "", "", errInvalidSignature},
+		{"v2 short addresses", encodeV2(commandProxy, familyInet, inet[:8]), "", "", "", errInvalidHeader},
+		{"v2 truncated", encodeV2(commandProxy, familyInet, inet)[:20], "", "", "", io.ErrUnexpectedEOF},
+		{"v2 too long", encodeV2(commandProxy, familyInet, make([]byte, maxHeaderLength+1)), "", "", "", errHeaderTooLong},
+		{"v2 verified certificate", encodeV2(commandProxy, familyInet, append(inet, encodeSSL(verified, 0, "alice")...)), "10.0.0.1:12345", "10.0.0.2:6666", "alice", nil},
+		{"v2 unverified certificate", encodeV2(commandProxy, familyInet, append(inet, encodeSSL(verified, 1, "alice")...)), "10.0.0.1:12345", "10.0.0.2:6666", "", nil},
+		{"v2 certificate of the session", encodeV2(commandProxy, familyInet, append(inet, encodeSSL(clientSSL|clientCertSess, 0, "alice")...)), "10.0.0.1:12345", "10.0.0.2:6666", "alice", nil},
+		{"v2 no certificate", encodeV2(commandProxy, familyInet, append(inet, encodeSSL(clientSSL, 0, "alice")...)), "10.0.0.1:12345", "10.0.0.2:6666", "", nil},
+		{"v2 other tlv", encodeV2(commandProxy, familyInet, append(inet, encodeTLV(0x04, []byte("noop"))...)), "10.0.0.1:12345", "10.0.0.2:6666", "", nil},
+		{"v2 truncated tlv", encodeV2(commandProxy, familyInet, append(inet, encodeSSL(verified, 0, "alice")[:10]...)), "", "", "", errInvalidHeader},
+		{"v2 short ssl tlv", encodeV2(commandProxy, familyInet, append(inet, encodeTLV(typeSSL, []byte{verified})...)), "", "", "", errInvalidHeader},
+		{"command", []byte("GET key\r\n"), "", "", "", errInvalidSignature},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data := test.data
+			if test.err == nil { // Followed by a request, unless the header is incomplete
+				data = append(data, "GET key\r\n"...)
+			}
+			r := bytes.NewReader(data)
+			header, err := ReadHeader(r)
+			if err != test.err {
+				t.Fatalf("got error %v, want %v", err, test.err)
+			}
+			if err != nil {
+				return
+			}
+			if got := addrString(header.Source); got != test.source {
+				t.Fatalf("got source '%s', want '%s'", got, test.source)
+			}
+			if got := addrString(header.Destination); got != test.destination {
+				t.Fatalf("got destination '%s', want '%s'", got, test.destination)
+			}
+			if header.CommonName != test.commonName {
+				t.Fatalf("got common name '%s', want '%s'", header.CommonName, test.commonName)
+			}
+			if rest, _ := io.ReadAll(r); string(rest) != "GET key\r\n" { // Data following the header isn't consumed
+				t.Fatalf("got %q following the header", rest)
+			}
+		})
+	}
+}
+
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+func TestParseSources(t *testing.T) {
+	sources, err := ParseSources(" 10.0.0.0/8, 192.168.1.10 ,fd00::/8,::1,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		addr    net.Addr
+		trusted bool
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("10.1.2.3")}, true},
+		{&net.TCPAddr{IP: net.ParseIP("11.0.0.1")}, false},
+		{&net.TCPAddr{IP: net.ParseIP("192.168.1.10")}, true},
+		{&net.TCPAddr{IP: net.ParseIP("192.168.1.11")}, false},
+		{&net.TCPAddr{IP: net.ParseIP("::ffff:10.1.2.3")}, true}, // IPv4-mapped
+		{&net.TCPAddr{IP: net.ParseIP("fd12::1")}, true},
+		{&net.TCPAddr{IP: net.ParseIP("::1")}, true},
+		{&net.TCPAddr{IP: net.ParseIP("::2")}, false},
+		{&net.UnixAddr{Name: "/tmp/valhaj.sock", Net: "unix"}, false}, // Any local process may connect
+		{&net.UDPAddr{IP: net.ParseIP("10.1.2.3")}, false},
+	}
+	for _, test := range tests {
+		if got := sources.Contains(test.addr); got != test.trusted {
+			t.Errorf("address '%s': got %v, want %v", test.addr, got, test.trusted)
+		}
+	}
+	if (*Sources)(nil).Contains(&net.TCPAddr{IP: net.ParseIP("10.1.2.3")}) {
+		t.Fatal("no sources trusted an address")
+	}
+
+	for _, list := range []string{"unix", "10.0.0.0/33", "10.0.0", "/tmp/valhaj.sock", "localhost"} {
+		if _, err := ParseSources(list); err == nil {
+			t.Errorf("invalid source '%s' was accepted", list)
+		}
+	}
+}
@@ -3,98 +3,109 @@ package reader
 import (
 	"bufio"
 	"errors"
+	"io"
 	"net"
+	"slices"
+	"time"
 
 	"lj.com/valhaj/internal/commands"
+	"lj.com/valhaj/internal/config"
 )
 
 var (
 	errIncompleteEmptyData = errors.New("incomplete or empty client data stream")
 	errIncongruousQuotes   = errors.New("incongruous quotes")
+	errInvalidCount        = errors.New("invalid argument count, expected '!<count>' or '*<count>'")
+	errInvalidLength       = errors.New("invalid argument length, expected '$<length>'")
+	errUnterminatedBulk    = errors.New("argument isn't terminated by '\\r\\n'")
+	errLineLength          = errors.New("request line is too long")
+	errArgumentCount       = errors.New("too many arguments")
+	errRequestTimeout      = errors.New("timeout in the middle of a request")
 
-	readEmptyMessage = 2 // Empty messages are fine (can be: "\r\n", len=2)
-	readMinMessage   = 3 // Don't tolerate empty messages (at least: "X\r\n", len=3)
+	readMinMessage = 3       // Don't tolerate empty messages (at least: "X\r\n", len=3)
+	readChunkSize  = 65536   // Arguments are read in chunks, so memory is only used for the bytes that were actually received
+	readRetainSize = 1 << 20 // Larger buffers are released after the request, so idle sessions don't hold on to them
 )
 
+// Flusher sends buffered replies, see SetFlusher().
+type Flusher interface {
+	Flush() error
+}
+
 // Reader contains the logic to read from a raw tcp connection and create commands.
+// The buffers are reused for every request, the arguments are sliced from a single string per request. Keeping any of them keeps the whole request
+// in memory, so what outlives the request has to be copied (e.g. stored keys and values, see memory).
 type Reader struct {
-	conn net.Conn
-	br   *bufio.Reader
-	line []byte
-	pos  int
+	conn     net.Conn
+	br       *bufio.Reader
+	line     []byte   // Lines exceeding the buffer of br
+	buf      []byte   // Arguments of a length-prefixed request
+	bounds   []int    // Ends of the arguments in buf
+	args     []string // Arguments of the last request
+	protocol int
+	flusher  Flusher
 }
 
-// NewReader(): Returns a new Reader that reads from the given connection.
-func NewReader(conn net.Conn) *Reader {
-	return &Reader{
-		conn: conn,
-		br:   bufio.NewReader(conn),
-		line: make([]byte, 0),
-		pos:  0,
-	}
+// connReader flushes the replies before reading from the connection, which blocks until the client sends more data.
+type connReader struct {
+	r *Reader
 }
 
-func (r *Reader) current() byte {
-	if r.end() {
-		return '\n'
+func (c connReader) Read(b []byte) (int, error) {
+	if c.r.flusher != nil {
+		if err := c.r.flusher.Flush(); err != nil {
+			return 0, err
+		}
 	}
-	return r.line[r.pos]
-}
-
-func (r *Reader) advance() {
-	r.pos++
+	return c.r.conn.Read(b)
 }
 
-func (r *Reader) end() bool {
-	return r.pos >= len(r.line)
+// NewReader(): Returns a new Reader that reads from the given connection.
+func NewReader(conn net.Conn) *Reader {
+	r := &Reader{
+		conn:     conn,
+		protocol: 1,
+	}
+	r.br = bufio.NewReader(connReader{r})
+	return r
 }
 
-// consumeString(): Reads a string argument from the current line.
-func (r *Reader) consumeString() (s []byte, err error) {
-	var escape byte = '\\'
-	for r.current() != '"' && !r.end() {
-		cur := r.current()
-		r.advance()
-		if cur == escape {
-			next := r.current()
-			s = append(s, cur, next)
-			r.advance()
-		} else {
-			s = append(s, cur)
-		}
-	}
-	if r.current() != '"' {
-		return nil, errIncongruousQuotes
-	}
-	r.advance()
-	return
+// SetProtocol(): Sets the protocol version of the following requests, as negotiated with the 'HELLO' command.
+func (r *Reader) SetProtocol(protocol int) {
+	r.protocol = protocol
 }
 
-// consumeArg(): Reads an argument from the current line.
-func (r *Reader) consumeArg() (s string, err error) {
-	for r.current() == ' ' {
-		r.advance()
-	}
-	if r.current() == '"' {
-		r.advance()
-		buf, err := r.consumeString()
-		return string(buf), err
-	}
-	for !r.end() && r.current() != ' ' && r.current() != '\n' {
-		s += string(r.current())
-		r.advance()
-	}
-	return
+// SetFlusher(): Flushes the replies whenever the received data was read, so pipelined requests are answered at once
+// and a client waiting for replies before it sends the rest of a request isn't kept waiting.
+func (r *Reader) SetFlusher(flusher Flusher) {
+	r.flusher = flusher
 }
 
+// readLine(): Reads a "\r\n" terminated line of at most ReaderMaxLineLength bytes, without the terminator.
+// The line is only valid until the next read.
 func (r *Reader) readLine() ([]byte, error) {
-	line, err := r.br.ReadBytes('\n')
+	line, err := r.br.ReadSlice('\n')
+	if err == bufio.ErrBufferFull { // Only lines exceeding the buffer are copied
+		r.line = append(r.line[:0], line...)
+		for err == bufio.ErrBufferFull {
+			if len(r.line) > config.ReaderMaxLineLength+2 {
+				return nil, errLineLength
+			}
+			r.extendDeadline()
+			line, err = r.br.ReadSlice('\n')
+			r.line = append(r.line, line...)
+		}
+		line = r.line
+	}
 	if err != nil {
 		return nil, err
 	}
 
 	// Check for complete, "\r\n" terminated data stream
 	lineLen := len(line)
+	if lineLen > config.ReaderMaxLineLength+2 {
+		return nil, errLineLength
+	}
 	if lineLen < readMinMessage {
 		return nil, errIncompleteEmptyData
 	}
@@ -104,29 +115,172 @@ func (r *Reader) readLine() ([]byte, error) {
 	return line[:lineLen-2], nil
 }
 
-// Read(): Reads and returns a commands.Command.
-func (r *Reader) Read() (commands.Command, error) {
+// readCount(): Reads a '<prefix><n>\r\n' line of a length-prefixed request, n must be within 0 and limit. Returns invalid if it isn't.
+func (r *Reader) readCount(prefix byte, limit int, invalid error) (int, error) {
 	line, err := r.readLine()
 	if err != nil {
-		return commands.Command{}, err
+		return 0, err
+	}
+	if line[0] != prefix || len(line) < 2 {
+		return 0, invalid
 	}
-	r.pos = 0
-	r.line = []byte{}
-	r.line = append(r.line, line...)
+	n := 0
+	for _, c := range line[1:] { // Parsed in place, strconv would need a string
+		if c < '0' || c > '9' {
+			return 0, invalid
+		}
+		if n = n*10 + int(c-'0'); n > limit {
+			return 0, invalid
+		}
+	}
+	return n, nil
+}
 
-	// Skip initial whitespace if any
-	for r.current() == ' ' {
-		r.advance()
+// readFull(): Appends n bytes to buf. The buffer grows with the received bytes, not with the announced length.
+func (r *Reader) readFull(n int) error {
+	for n > 0 {
+		chunk := min(n, readChunkSize)
+		start := len(r.buf)
+		if cap(r.buf)-start < chunk {
+			r.buf = slices.Grow(r.buf, max(chunk, start)) // Doubles, append would only grow large buffers by a quarter
+		}
+		if _, err := io.ReadFull(r.br, r.buf[start:start+chunk]); err != nil {
+			return err
+		}
+		r.buf = r.buf[:start+chunk]
+		n -= chunk
+		r.extendDeadline()
 	}
+	return nil
+}
+
+// readBulk(): Reads a length-prefixed request (protocol 2): '<prefix><count>\r\n' followed by count arguments, each '$<length>\r\n<bytes>\r\n'.
+// Arguments are binary-safe, they're kept verbatim without escaping. The prefix is '!', or '*' for RESP.
+func (r *Reader) readBulk(prefix byte) (commands.Command, error) {
 	cmd := commands.Command{Connection: r.conn}
-	for !r.end() {
-		arg, err := r.consumeArg()
+	count, err := r.readCount(prefix, config.ReaderMaxArguments, errInvalidCount)
+	if err != nil {
+		return cmd, err
+	}
+	r.buf, r.bounds = r.buf[:0], r.bounds[:0]
+	for i := 0; i < count; i++ {
+		length, err := r.readCount('$', config.ReaderMaxBulkLength, errInvalidLength)
 		if err != nil {
 			return cmd, err
 		}
+		if err := r.readFull(length + 2); err != nil {
+			return cmd, err
+		}
+		if r.buf[len(r.buf)-2] != '\r' || r.buf[len(r.buf)-1] != '\n' {
+			return cmd, errUnterminatedBulk
+		}
+		r.buf = r.buf[:len(r.buf)-2]
+		r.bounds = append(r.bounds, len(r.buf))
+	}
+
+	s := string(r.buf) // The only allocation, all arguments share it
+	if cap(r.buf) > readRetainSize {
+		r.buf = nil
+	}
+	r.args = r.args[:0]
+	start := 0
+	for _, end := range r.bounds {
+		r.args = append(r.args, s[start:end])
+		start = end
+	}
+	cmd.Arguments = r.args
+	return cmd, nil
+}
+
+// split(): Splits a line-based request (protocol 1) into its arguments in a single pass, they're substrings of the line.
+// Arguments are separated by spaces, unless quoted. Within quotes, a backslash escapes the next character, both are kept verbatim.
+func (r *Reader) split(line string) error {
+	r.args = r.args[:0]
+	for i := 0; i < len(line); {
+		if line[i] == ' ' {
+			i++
+			continue
+		}
+
+		var arg string
+		if line[i] == '"' {
+			start := i + 1
+			for i = start; i < len(line) && line[i] != '"'; i++ {
+				if line[i] == '\\' {
+					i++
+				}
+			}
+			if i >= len(line) {
+				return errIncongruousQuotes
+			}
+			arg = line[start:i]
+			i++
+		} else {
+			start := i
+			for i < len(line) && line[i] != ' ' {
+				i++
+			}
+			arg = line[start:i]
+		}
+
 		if arg != "" {
-			cmd.Arguments = append(cmd.Arguments, arg)
+			if len(r.args) == config.ReaderMaxArguments {
+				return errArgumentCount
+			}
+			r.args = append(r.args, arg)
 		}
 	}
+	return nil
+}
+
+// extendDeadline(): Gives the client ReaderRequestTimeout to send the rest of the request.
+func (r *Reader) extendDeadline() {
+	r.conn.SetDeadline(time.Now().Add(config.ReaderRequestTimeout * time.Millisecond))
+}
+
+// Read(): Reads and returns a commands.Command. The slice of its arguments is reused by the next call, the arguments themselves stay valid.
+// A timeout is only returned while waiting for a request. Once it started, the session has to be closed on a timeout, as part of the request was read already.
+func (r *Reader) Read() (commands.Command, error) {
+	first, err := r.br.Peek(1)
+	if err != nil {
+		return commands.Command{}, err
+	}
+	r.extendDeadline()
+	cmd, err := r.readRequest(first[0])
+	if err != nil && isTimeout(err) {
+		return cmd, errRequestTimeout
+	}
+	return cmd, err
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// readRequest(): Reads a request, the first byte tells whether it's a RESP request.
+func (r *Reader) readRequest(first byte) (commands.Command, error) {
+	if first == '*' { // RESP array, as sent by Redis clients. Detected per request, so clients don't need to negotiate
+		cmd, err := r.readBulk('*')
+		cmd.RESP = 2
+		return cmd, err
+	}
+	if r.protocol >= 2 {
+		return r.readBulk('!')
+	}
+	line, err := r.readLine()
+	if err != nil {
+		return commands.Command{}, err
+	}
+
+	cmd := commands.Command{Connection: r.conn}
+	err = r.split(string(line)) // The only allocation, all arguments share it
+	if cap(r.line) > readRetainSize {
+		r.line = nil
+	}
+	if err != nil {
+		return cmd, err
+	}
+	cmd.Arguments = r.args
 	return cmd, nil
 }
@@ -0,0 +1,346 @@
+package reader
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// loopConn serves the same data over and over, like a client pipelining the same requests.
+type loopConn struct {
+	net.Conn
+	data []byte
+	pos  int
+}
+
+func (c *loopConn) Read(b []byte) (int, error) {
+	n := 0
+	for n < len(b) {
+		copied := copy(b[n:], c.data[c.pos:])
+		n += copied
+		c.pos = (c.pos + copied) % len(c.data)
+	}
+	return n, nil
+}
+
+// onceConn serves the data once, followed by io.EOF.
+type onceConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *onceConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *onceConn) SetDeadline(time.Time) error {
+	return nil
+}
+
+func (c *loopConn) SetDeadline(time.Time) error {
+	return nil
+}
+
+// stallConn serves the data in parts, each followed by a timeout, like a slow client.
+type stallConn struct {
+	net.Conn
+	parts    [][]byte
+	timedOut bool
+}
+
+func (c *stallConn) Read(b []byte) (int, error) {
+	if c.timedOut || len(c.parts) == 0 {
+		c.timedOut = false
+		return 0, &net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded}
+	}
+	n := copy(b, c.parts[0])
+	if c.parts[0] = c.parts[0][n:]; len(c.parts[0]) == 0 {
+		c.parts, c.timedOut = c.parts[1:], true
+	}
+	return n, nil
+}
+
+func (c *stallConn) SetDeadline(time.Time) error {
+	return nil
+}
+
+func newOnceReader(data []byte, protocol int) *Reader {
+	r := NewReader(&onceConn{r: bytes.NewReader(data)})
+	r.SetProtocol(protocol)
+	return r
+}
+
+// encodeBulk(): Encodes the arguments as a length-prefixed request with the given prefix ('!' or '*').
+func encodeBulk(prefix byte, args ...string) []byte {
+	b := []byte{prefix}
+	b = strconv.AppendInt(b, int64(len(args)), 10)
+	b = append(b, "\r\n"...)
+	for _, arg := range args {
+		b = append(b, '$')
+		b = strconv.AppendInt(b, int64(len(arg)), 10)
+		b = append(b, "\r\n"...)
+		b = append(b, arg...)
+		b = append(b, "\r\n"...)
+	}
+	return b
+}
+
+// splitReference(): The previous byte-by-byte parser of line-based requests, split() has to behave the same.
+// Except for non-ASCII bytes of unquoted arguments, which it converted to runes ('string(byte)') and split() keeps verbatim.
+func splitReference(line string) ([]string, error) {
+	var args []string
+	pos := 0
+	current := func() byte {
+		if pos >= len(line) {
+			return '\n'
+		}
+		return line[pos]
+	}
+	for pos < len(line) {
+		for current() == ' ' {
+			pos++
+		}
+		var arg string
+		if current() == '"' {
+			pos++
+			var s []byte
+			for current() != '"' && pos < len(line) {
+				cur := current()
+				pos++
+				if cur == '\\' {
+					s = append(s, cur, current())
+					pos++
+				} else {
+					s = append(s, cur)
+				}
+			}
+			if current() != '"' {
+				return args, errIncongruousQuotes
+			}
+			pos++
+			arg = string(s)
+		} else {
+			for pos < len(line) && current() != ' ' && current() != '\n' {
+				arg += string([]byte{current()})
+				pos++
+			}
+		}
+		if arg != "" {
+			args = append(args, arg)
+		}
+	}
+	return args, nil
+}
+
+func TestRead(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []byte
+		protocol int
+		args     []string
+		err      error
+	}{
+		{"line", []byte("SET key value\r\n"), 1, []string{"SET", "key", "value"}, nil},
+		{"spaces", []byte("  GET   key  \r\n"), 1, []string{"GET", "key"}, nil},
+		{"quoted", []byte("SET key \"a b\" \"\"\r\n"), 1, []string{"SET", "key", "a b"}, nil},
+		{"escaped", []byte("SET key \"a \\\"b\\\" \\\\\"\r\n"), 1, []string{"SET", "key", "a \\\"b\\\" \\\\"}, nil},
+		{"utf-8", []byte("SET ключ \"ü é\"\r\n"), 1, []string{"SET", "ключ", "ü é"}, nil},
+		{"unterminated", []byte("SET key \"a\r\n"), 1, nil, errIncongruousQuotes},
+		{"empty", []byte("\r\n"), 1, nil, errIncompleteEmptyData},
+		{"bulk", encodeBulk('!', "SET", "key", "a\r\nb", ""), 2, []string{"SET", "key", "a\r\nb", ""}, nil},
+		{"resp", encodeBulk('*', "GET", "key"), 1, []string{"GET", "key"}, nil},
+		{"count", []byte("!x\r\n"), 2, nil, errInvalidCount},
+		{"too many arguments", []byte("!99999999\r\n"), 2, nil, errInvalidCount},
+		{"too long", []byte("!1\r\n$999999999\r\n"), 2, nil, errInvalidLength},
+		{"unterminated bulk", []byte("!1\r\n$1\r\nab\r\n"), 2, nil, errUnterminatedBulk},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cmd, err := newOnceReader(test.data, test.protocol).Read()
+			if err != test.err {
+				t.Fatalf("got error %v, want %v", err, test.err)
+			}
+			if err == nil && !slices.Equal(cmd.Arguments, test.args) {
+				t.Fatalf("got arguments %q, want %q", cmd.Arguments, test.args)
+			}
+		})
+	}
+}
+
+func TestReadLongLine(t *testing.T) {
+	value := strings.Repeat("v", 100000) // Exceeds the buffer of the bufio.Reader
+	r := newOnceReader([]byte("SET key "+value+"\r\nGET key\r\n"), 1)
+	for _, want := range [][]string{{"SET", "key", value}, {"GET", "key"}} {
+		cmd, err := r.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(cmd.Arguments, want) {
+			t.Fatalf("got %d arguments, want %d", len(cmd.Arguments), len(want))
+		}
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	value := strings.Repeat("v", 100000)
+	tests := []struct {
+		name     string
+		parts    [][]byte
+		protocol int
+	}{
+		{"line", [][]byte{[]byte("SET key "), []byte("value\r\n")}, 1},
+		{"long line", [][]byte{[]byte("SET key " + value), []byte("\r\n")}, 1},
+		{"bulk", [][]byte{[]byte("!3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$26\r\n"), encodeBulk('!', "ECHO", "pwnd")}, 2},
+		{"resp", [][]byte{[]byte("*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$26\r\n"), encodeBulk('*', "ECHO", "pwnd")}, 1},
+		{"large value", [][]byte{encodeBulk('!', "SET", "key", value)[:50000], []byte("rest")}, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := NewReader(&stallConn{parts: test.parts})
+			r.SetProtocol(test.protocol)
+			if _, err := r.Read(); err != errRequestTimeout {
+				t.Fatalf("got error %v, want %v", err, errRequestTimeout)
+			}
+		})
+	}
+
+	// Waiting for a request may time out, the session polls for a shutdown meanwhile
+	r := NewReader(&stallConn{})
+	if _, err := r.Read(); err == nil || !err.(net.Error).Timeout() {
+		t.Fatalf("got error %v, want a timeout", err)
+	}
+}
+
+func TestReadAllocations(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []byte
+		protocol int
+	}{
+		{"line", []byte("SET key value\r\n"), 1},
+		{"quoted", []byte("SET key \"a \\\"quoted\\\" value\"\r\n"), 1},
+		{"bulk", encodeBulk('!', "SET", "key", "a\r\nvalue"), 2},
+		{"resp", encodeBulk('*', "SET", "key", "value"), 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := NewReader(&loopConn{data: test.data})
+			r.SetProtocol(test.protocol)
+			allocs := testing.AllocsPerRun(1000, func() {
+				if _, err := r.Read(); err != nil {
+					t.Fatal(err)
+				}
+			})
+			if allocs > 1 { // The arguments share a single string
+				t.Fatalf("got %v allocations per request, want at most 1", allocs)
+			}
+		})
+	}
+}
+
+func FuzzSplit(f *testing.F) {
+	for _, line := range []string{"SET key value", " GET  key ", "SET key \"a b\"", "SET \"a\\\"b\" \"\"", "\"a", "\"a\\", "a\"b c\"d"} {
+		f.Add(line)
+	}
+	f.Fuzz(func(t *testing.T, line string) {
+		if strings.Contains(line, "\n") { // Lines are split at line breaks
+			t.Skip()
+		}
+		r := NewReader(nil)
+		err := r.split(line)
+		want, wantErr := splitReference(line)
+		if err != wantErr {
+			t.Fatalf("got error %v, want %v", err, wantErr)
+		}
+		if err == nil && !slices.Equal(r.args, want) {
+			t.Fatalf("got arguments %q, want %q", r.args, want)
+		}
+	})
+}
+
+func FuzzReadBulk(f *testing.F) {
+	f.Add("SET", "key", "value")
+	f.Add("", "a\r\nb", "\"\\")
+	f.Fuzz(func(t *testing.T, a, b, c string) {
+		data := append(encodeBulk('!', a, b, c), encodeBulk('*', c, b, a)...)
+		r := newOnceReader(data, 2)
+		for _, want := range [][]string{{a, b, c}, {c, b, a}} {
+			cmd, err := r.Read()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(cmd.Arguments, want) {
+				t.Fatalf("got arguments %q, want %q", cmd.Arguments, want)
+			}
+		}
+	})
+}
+
+func FuzzRead(f *testing.F) {
+	f.Add([]byte("SET key value\r\nGET key\r\n"), 1)
+	f.Add([]byte("SET \"a b\r\n"), 1)
+	f.Add(encodeBulk('!', "GET", "key"), 2)
+	f.Add([]byte("*2\r\n$3\r\nGET\r\n$9\r\nkey"), 1)
+	f.Fuzz(func(t *testing.T, data []byte, protocol int) {
+		r := newOnceReader(data, protocol)
+		for {
+			cmd, err := r.Read()
+			if err != nil {
+				return
+			}
+			for _, arg := range cmd.Arguments {
+				if cmd.RESP == 0 && protocol < 2 && (arg == "" || strings.ContainsAny(arg, "\n")) {
+					t.Fatalf("invalid argument %q", arg)
+				}
+			}
+		}
+	})
+}
+
+func benchmarkRead(b *testing.B, data []byte, protocol int) {
+	r := NewReader(&loopConn{data: data})
+	r.SetProtocol(protocol)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		if _, err := r.Read(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReadLine(b *testing.B) {
+	benchmarkRead(b, []byte("SET key:000001 value:000001\r\n"), 1)
+}
+
+func BenchmarkReadQuoted(b *testing.B) {
+	benchmarkRead(b, []byte("SET key:000001 \"a \\\"quoted\\\" value with spaces\"\r\n"), 1)
+}
+
+func BenchmarkReadBulk(b *testing.B) {
+	benchmarkRead(b, encodeBulk('!', "SET", "key:000001", "value:000001"), 2)
+}
+
+func BenchmarkReadRESP(b *testing.B) {
+	benchmarkRead(b, encodeBulk('*', "SET", "key:000001", "value:000001"), 1)
+}
+
+// The buffer exceeds readRetainSize, so it is released and grows again for every request.
+func BenchmarkReadLargeValue(b *testing.B) {
+	benchmarkRead(b, encodeBulk('!', "SET", "key", strings.Repeat("v", 1<<20)), 2)
+}
+
+func BenchmarkSplitReference(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := splitReference("SET key:000001 value:000001"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// issue(): Creates a certificate signed by the parent, self-signed if it's nil.
+func issue(t *testing.T, commonName string, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		DNSNames:              []string{commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// writePEM(): Writes the certificate and its key to the directory, returning the paths.
+func writePEM(t *testing.T, dir, name string, cert *x509.Certificate, key *ecdsa.PrivateKey) (string, string) {
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, name+"-cert.pem"), filepath.Join(dir, name+"-key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestClientCertificateCA(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := issue(t, "valhaj CA", true, nil, nil)
+	foreignCA, foreignKey := issue(t, "foreign CA", true, nil, nil)
+	serverCert, serverKey := issue(t, "localhost", false, ca, caKey)
+
+	caFile, _ := writePEM(t, dir, "ca", ca, caKey)
+	publicCAFile, _ := writePEM(t, dir, "public", foreignCA, foreignKey)
+	t.Setenv("SSL_CERT_FILE", publicCAFile) // The foreign CA is trusted by the system, like a public CA
+	certFile, keyFile := writePEM(t, dir, "server", serverCert, serverKey)
+	certificates, err := NewCertificates(caFile, certFile, keyFile, "require")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	tests := []struct {
+		name     string
+		ca       *x509.Certificate
+		caKey    *ecdsa.PrivateKey
+		accepted bool
+	}{
+		{"configured CA", ca, caKey, true},
+		{"foreign CA", foreignCA, foreignKey, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clientCert, clientKey := issue(t, "alice", false, test.ca, test.caKey)
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			defer serverConn.Close()
+
+			client := tls.Client(clientConn, &tls.Config{
+				RootCAs:      roots,
+				ServerName:   "localhost",
+				Certificates: []tls.Certificate{{Certificate: [][]byte{clientCert.Raw}, PrivateKey: clientKey}},
+				MinVersion:   tls.VersionTLS13,
+			})
+			go func() {
+				client.Handshake()
+				client.Read(make([]byte, 1)) // Receives the alert if the certificate is rejected
+				clientConn.Close()
+			}()
+
+			err := tls.Server(serverConn, certificates.Config()).Handshake()
+			if test.accepted && err != nil {
+				t.Fatalf("certificate was rejected: %s", err)
+			}
+			if !test.accepted && err == nil {
+				t.Fatal("certificate of a foreign CA was accepted")
+			}
+		})
+	}
+}
@@ -1,39 +1,113 @@
 package server
 
 import (
+	"crypto/tls"
+	"fmt"
 	"io"
 	"log"
 	"net"
+	"os"
+	"path/filepath"
 	"sync"
+	"syscall"
 	"time"
 
+	"lj.com/valhaj/internal/auth"
 	"lj.com/valhaj/internal/config"
 	"lj.com/valhaj/internal/memory"
+	"lj.com/valhaj/internal/proxyproto"
 	"lj.com/valhaj/internal/reader"
 	"lj.com/valhaj/internal/writer"
 )
 
 type Server struct {
-	listener net.Listener
-	quit     chan bool
-	WG       sync.WaitGroup
+	listener       net.Listener
+	tlsConfig      *tls.Config
+	admin          bool                // Sessions have administrative permissions, regardless of authentication
+	proxied        bool                // Sessions must send a PROXY protocol header, the listener is only accessible by valhaj-proxy
+	TrustedProxies *proxyproto.Sources // Clients that must send a PROXY protocol header, which they're trusted with
+	quit           chan bool
+	WG             sync.WaitGroup
 }
 
-// NewServer(): Creates a new server instance.
-func NewServer(network, address string) *Server {
+// NewServer(): Creates a new server instance. Terminates TLS if a configuration is given.
+func NewServer(network, address string, tlsConfig *tls.Config) *Server {
 	listener, err := net.Listen(network, address)
 	if err != nil {
 		log.Fatal(err)
 	}
-	log.Printf("Listening on %s: %s\n", network, address)
+	if tlsConfig != nil {
+		log.Printf("Listening on %s (TLS): %s\n", network, address)
+	} else {
+		log.Printf("Listening on %s: %s\n", network, address)
+	}
+
+	s := &Server{
+		listener:  listener,
+		tlsConfig: tlsConfig,
+		quit:      make(chan bool),
+	}
+	return s
+}
+
+// NewAdminServer(): Creates a server instance whose sessions have administrative permissions. UNIX sockets are only accessible by the owner.
+func NewAdminServer(network, address string) *Server {
+	listener, err := listenPrivate(network, address)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Listening on %s (admin): %s\n", network, address)
 
 	s := &Server{
 		listener: listener,
+		admin:    true,
 		quit:     make(chan bool),
 	}
 	return s
 }
 
+// NewProxyServer(): Creates a server instance for valhaj-proxy, every session must start with a PROXY protocol header. UNIX sockets are only accessible by the owner.
+func NewProxyServer(network, address string) *Server {
+	listener, err := listenPrivate(network, address)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Listening on %s (proxy): %s\n", network, address)
+
+	s := &Server{
+		listener: listener,
+		proxied:  true,
+		quit:     make(chan bool),
+	}
+	return s
+}
+
+// listenPrivate(): Listens on a UNIX socket inside a directory that only the owner may access, so the socket is never accessible by others,
+// not even before its permissions could be changed. The directory is created if it doesn't exist. Other networks are listened on as they are.
+func listenPrivate(network, address string) (net.Listener, error) {
+	if network != config.ServerUnixNetwork {
+		return net.Listen(network, address)
+	}
+	dir := filepath.Dir(address)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return nil, err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !info.IsDir() || !ok || int(stat.Uid) != os.Getuid() || info.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("directory '%s' of the socket must be owned by the server's user and only be accessible by it (0700)", dir)
+	}
+	if conn, err := net.Dial(network, address); err == nil {
+		conn.Close() // Still in use, listening fails below
+	} else {
+		os.Remove(address) // Left behind by a server that didn't shut down gracefully
+	}
+	return net.Listen(network, address)
+}
+
 // Quit(): Shuts down the server instance.
 func (s *Server) Quit() {
 	close(s.quit)
@@ -67,9 +141,12 @@ func (s *Server) Serve() {
 
 // StartSession(): Runs the client's session. Reads and executes commands and writes responses back to the client.
 func (s *Server) StartSession(conn net.Conn) {
-	var oldIndex = -1
-	var newIndex = 0
-	var database memory.ShardedCache
+	var selected = config.MemoryDefaultDatabase
+	var namespace string
+	var user *auth.User
+	var failures int // Failed authentications
+	var protocol = 1
+	var resp = 2 // RESP version for requests of Redis clients
 	var status bool
 
 	defer func() {
@@ -81,7 +158,42 @@ func (s *Server) StartSession(conn net.Conn) {
 		}
 	}()
 
+	if s.proxied || s.TrustedProxies.Contains(conn.RemoteAddr()) {
+		// The header precedes everything else, including the TLS handshake
+		conn.SetDeadline(time.Now().Add(config.ServerHandshakeTimeout * time.Millisecond))
+		header, err := proxyproto.ReadHeader(conn)
+		if err != nil {
+			log.Printf("Invalid PROXY protocol header from %s: %s\n", conn.RemoteAddr(), err)
+			return
+		}
+		conn = header.Wrap(conn)
+		if header.CommonName != "" && config.AuthCertificateUsers {
+			if identityUser, ok := auth.IdentityUser(header.CommonName); ok {
+				user, namespace = identityUser, identityUser.Namespace()
+			}
+		}
+	}
+
+	if s.tlsConfig != nil {
+		// Handshake before reading, so a verified client certificate authenticates the session right away
+		tlsConn := tls.Server(conn, s.tlsConfig)
+		conn = tlsConn
+		tlsConn.SetDeadline(time.Now().Add(config.ServerHandshakeTimeout * time.Millisecond))
+		if err := tlsConn.Handshake(); err != nil {
+			log.Printf("TLS handshake with %s failed: %s\n", conn.RemoteAddr(), err)
+			return
+		}
+		if chains := tlsConn.ConnectionState().VerifiedChains; config.AuthCertificateUsers && len(chains) > 0 {
+			if certUser, ok := auth.CertificateUser(chains[0][0]); ok {
+				user, namespace = certUser, certUser.Namespace()
+			}
+		}
+	}
+
 	r := reader.NewReader(conn)
+	w := writer.NewWriter(conn)
+	r.SetFlusher(w)
+	defer w.Flush() // Replies of the last requests, e.g. 'QUIT'
 
 SessionLoop:
 	for {
@@ -98,29 +210,44 @@ SessionLoop:
 					return
 				} else {
 					// We're closing the client connection due to other errors, no need to handle write errors
-					responses := []string{"!1\r\n", "-ERR ", err.Error(), "\r\n"}
-					_, _ = conn.Write(writer.BuildResponse(responses))
+					conn.SetDeadline(time.Now().Add(config.ServerGracefulShutdownDelay * time.Millisecond)) // May have expired in the middle of a request
+					w.SetRESP(cmd.RESP)
+					w.Error(err.Error())
 					return
 				}
 			}
 
 			if cmd.Empty() {
-				responses := []string{"!1\r\n", "-ERR superfluous write\r\n"}
-				_, _ = conn.Write(writer.BuildResponse(responses))
+				w.SetRESP(cmd.RESP)
+				w.Error("superfluous write")
 				return
 			}
 
-			if newIndex != oldIndex { // Only update the DB reference if the index changed
-				database = *memory.Container[newIndex]
-				oldIndex = newIndex
+			cmd.Selected = selected
+			cmd.Database, _ = memory.Container.Load(selected) // Always reload the DB reference, databases may have been swapped or dropped
+			cmd.Namespace = namespace
+			cmd.User = user
+			cmd.Failures = failures
+			cmd.Admin = s.admin
+			cmd.Protocol = protocol
+			cmd.Writer = w
+			if cmd.RESP != 0 {
+				cmd.RESP = resp
 			}
-			cmd.Index = newIndex
-			cmd.Database = database
 
-			newIndex, status = cmd.Execute()
+			selected, status = cmd.Execute()
+			namespace, user, failures, protocol = cmd.Namespace, cmd.User, cmd.Failures, cmd.Protocol
+			if cmd.RESP != 0 {
+				resp = cmd.RESP
+			}
+			r.SetProtocol(protocol)
+			w.SetProtocol(protocol)
 			if !status {
 				return
 			}
+			if w.Err() != nil {
+				return
+			}
 		}
 	}
 }
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenPrivate(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "sockets")
+	address := filepath.Join(dir, "admin.sock")
+	listener, err := listenPrivate("unix", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0700 {
+		t.Fatalf("got directory permissions %o, want 700", perm)
+	}
+	conn, err := net.Dial("unix", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	listener.Close()
+
+	// A directory others may access isn't used, e.g. one created by another local user
+	if err := os.Chmod(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listenPrivate("unix", address); err == nil {
+		t.Fatal("listened inside a directory accessible by others")
+	}
+	if err := os.Chmod(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	// A socket left behind by a server that didn't shut down gracefully is replaced
+	if err := os.WriteFile(address, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	listener, err = listenPrivate("unix", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+}
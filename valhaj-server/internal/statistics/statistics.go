@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"lj.com/valhaj/internal/config"
+	"lj.com/valhaj/internal/memory"
 )
 
 var (
@@ -21,7 +22,7 @@ func InitStats() (time.Time, int) {
 }
 
 // GetStats(): Returns an updated list of dynamic and static metrics for the current session.
-func GetStats(index, totalKeys int) []string {
+func GetStats(name string, totalKeys, shardCount, databaseCount int) []string {
 	return []string{
 		strings.Join([]string{"server_pid:", strconv.Itoa(ProcessId)}, ""),
 		strings.Join([]string{"server_uptime:", time.Since(StartTime).Round(time.Second).String()}, ""),
@@ -32,8 +33,84 @@ func GetStats(index, totalKeys int) []string {
 		strings.Join([]string{"release_os_arch:", runtime.GOOS, "-", runtime.GOARCH}, ""),
 		strings.Join([]string{"release_go_version:", runtime.Version()}, ""),
 		strings.Join([]string{"keyspace_keys:", strconv.Itoa(totalKeys)}, ""),
-		strings.Join([]string{"memory_database_shards:", strconv.Itoa(config.MemoryCacheShardCount)}, ""),
-		strings.Join([]string{"memory_logical_databases:", strconv.Itoa(config.MemoryCacheContainerSize)}, ""),
-		strings.Join([]string{"memory_active_database:", strconv.Itoa(index)}, ""),
+		strings.Join([]string{"memory_database_shards:", strconv.Itoa(shardCount)}, ""),
+		strings.Join([]string{"memory_logical_databases:", strconv.Itoa(databaseCount)}, ""),
+		strings.Join([]string{"memory_active_database:", name}, ""),
 	}
 }
+
+// GetKeyspaceStats(): Returns the number of keys and keys with an expiration for each logical database.
+func GetKeyspaceStats(names []string, keys, expiring []int) []string {
+	stats := make([]string, 0, len(keys))
+	for index := range keys {
+		stats = append(stats, strings.Join([]string{
+			"keyspace_db", names[index], ":keys=", strconv.Itoa(keys[index]), ",expires=", strconv.Itoa(expiring[index]),
+		}, ""))
+	}
+	return stats
+}
+
+// GetMemoryStats(): Returns the memory usage in relation to the configured limit and the eviction metrics.
+func GetMemoryStats(usedMemory int64, evictedKeys uint64) []string {
+	return []string{
+		strings.Join([]string{"memory_used_bytes:", strconv.FormatInt(usedMemory, 10)}, ""),
+		strings.Join([]string{"memory_max_bytes:", strconv.Itoa(config.MemoryMaxBytes)}, ""),
+		strings.Join([]string{"memory_eviction_policy:", config.MemoryEvictionPolicy}, ""),
+		strings.Join([]string{"memory_evicted_keys:", strconv.FormatUint(evictedKeys, 10)}, ""),
+	}
+}
+
+// GetShardSummary(): Returns the key distribution across the shards of a database and their accumulated lock metrics.
+func GetShardSummary(subtotal []int, locks []memory.LockStats) []string {
+	var total, lowest, highest int
+	for index, keys := range subtotal {
+		total += keys
+		if index == 0 || keys < lowest {
+			lowest = keys
+		}
+		highest = max(highest, keys)
+	}
+	var imbalance float64 // Ratio of the fullest shard to the mean, 1 means perfectly balanced
+	if total > 0 {
+		imbalance = float64(highest) / (float64(total) / float64(len(subtotal)))
+	}
+
+	var acquisitions, contentions uint64
+	var waitTime time.Duration
+	for _, lock := range locks {
+		acquisitions += lock.Acquisitions
+		contentions += lock.Contentions
+		waitTime += lock.WaitTime
+	}
+
+	return []string{
+		strings.Join([]string{"memory_shard_keys_min:", strconv.Itoa(lowest)}, ""),
+		strings.Join([]string{"memory_shard_keys_max:", strconv.Itoa(highest)}, ""),
+		strings.Join([]string{"memory_shard_imbalance:", strconv.FormatFloat(imbalance, 'f', 2, 64)}, ""),
+		strings.Join([]string{"memory_lock_acquisitions:", strconv.FormatUint(acquisitions, 10)}, ""),
+		strings.Join([]string{"memory_lock_contentions:", strconv.FormatUint(contentions, 10)}, ""),
+		strings.Join([]string{"memory_lock_wait_us:", strconv.FormatInt(waitTime.Microseconds(), 10)}, ""),
+	}
+}
+
+// GetReshardStats(): Returns the progress of a resharding, the target is 0 unless resharding.
+func GetReshardStats(target, migrated int) []string {
+	return []string{
+		strings.Join([]string{"memory_resharding_target_shards:", strconv.Itoa(target)}, ""),
+		strings.Join([]string{"memory_resharding_migrated_shards:", strconv.Itoa(migrated)}, ""),
+	}
+}
+
+// GetShardStats(): Returns the shard summary, followed by the number of keys and the lock metrics of each shard of a database. While resharding, the shards of the target layout follow the current ones.
+func GetShardStats(subtotal []int, locks []memory.LockStats) []string {
+	stats := GetShardSummary(subtotal, locks)
+	for index, keys := range subtotal {
+		stats = append(stats, strings.Join([]string{
+			"shard_", strconv.Itoa(index), ":keys=", strconv.Itoa(keys),
+			",acquisitions=", strconv.FormatUint(locks[index].Acquisitions, 10),
+			",contentions=", strconv.FormatUint(locks[index].Contentions, 10),
+			",wait_us=", strconv.FormatInt(locks[index].WaitTime.Microseconds(), 10),
+		}, ""))
+	}
+	return stats
+}
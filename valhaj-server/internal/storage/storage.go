@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
@@ -13,22 +14,38 @@ import (
 	"lj.com/valhaj/internal/memory"
 )
 
-// CreateLabels(): Generates filenames for each database state backup.
-func CreateLabels() []string {
-	var containerSize = config.MemoryCacheContainerSize
-	var filename string
-	var labels = make([]string, 0, containerSize)
+var (
+	snapshotHeader = "#valhaj-snapshot 2" // Marks snapshots with quoted rows, older snapshots contain raw rows
+)
+
+// CreateLabel(): Generates the filename of the database state backup.
+func CreateLabel(name string) string {
+	return strings.Join([]string{config.StorageBasename, name, config.StorageExtension}, "")
+}
 
-	for i := 0; i < containerSize; i++ {
-		filename = strings.Join([]string{config.StorageBasename, strconv.Itoa(i), config.StorageExtension}, "")
-		labels = append(labels, filename)
+// FindLabels(): Returns the names of the databases with a state backup on disk.
+func FindLabels() []string {
+	fileNames, _ := filepath.Glob(CreateLabel("*")) // The pattern is always valid
+	names := make([]string, 0, len(fileNames))
+	for _, fileName := range fileNames {
+		name := strings.TrimSuffix(strings.TrimPrefix(fileName, config.StorageBasename), config.StorageExtension)
+		if memory.ValidName(name) {
+			names = append(names, name)
+		}
 	}
+	return names
+}
 
-	return labels
+// RemoveLabel(): Deletes the state backup of a database, if it exists.
+func RemoveLabel(name string) error {
+	if err := os.Remove(CreateLabel(name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("error removing snapshot file (%w)", err)
+	}
+	return nil
 }
 
 // DiskWrite(): Persists the database state to disk, if it's not empty.
-func DiskWrite(filename string, database memory.ShardedCache, index int) error {
+func DiskWrite(filename string, database *memory.ShardedCache, name string) error {
 	items, count := database.Range()
 	if len(items) == 0 {
 		return fmt.Errorf("no data to persist to disk")
@@ -40,19 +57,23 @@ func DiskWrite(filename string, database memory.ShardedCache, index int) error {
 	}
 	defer file.Close()
 
+	// Rows are quoted, so that binary values (e.g. bitmaps) can't break the line format
+	if _, err := fmt.Fprintf(file, "%s\n", snapshotHeader); err != nil {
+		return fmt.Errorf("error writing snapshot file (%w)", err)
+	}
 	for _, item := range items {
-		_, err := fmt.Fprintf(file, "%v\n", item)
+		_, err := fmt.Fprintf(file, "%q\n", item)
 		if err != nil {
 			return fmt.Errorf("error writing snapshot file (%w)", err)
 		}
 	}
 
-	log.Printf("Saved database snapshot id=%d containing %d key(s)\n", index, count)
+	log.Printf("Saved database snapshot id=%s containing %d key(s)\n", name, count)
 	return nil
 }
 
 // DiskRead(): Attempts to restore an old database state, if it exists.
-func DiskRead(filename string, database memory.ShardedCache, index int) error {
+func DiskRead(filename string, database *memory.ShardedCache, name string) error {
 	file, err := os.ReadFile(filename)
 	if err != nil {
 		if errors.Is(err, os.ErrNotExist) {
@@ -68,6 +89,11 @@ func DiskRead(filename string, database memory.ShardedCache, index int) error {
 		fileRows = fileRows[:rowCount-1]
 		rowCount -= 1
 	}
+	quoted := rowCount > 0 && fileRows[0] == snapshotHeader
+	if quoted {
+		fileRows = fileRows[1:]
+		rowCount -= 1
+	}
 	if rowCount%2 != 0 {
 		return fmt.Errorf("error loading incomplete snapshot")
 	}
@@ -75,6 +101,12 @@ func DiskRead(filename string, database memory.ShardedCache, index int) error {
 	pair := 0
 	var kv []string
 	for _, row := range fileRows {
+		if quoted {
+			row, err = strconv.Unquote(row)
+			if err != nil {
+				return fmt.Errorf("error loading malformed snapshot (%w)", err)
+			}
+		}
 		kv = append(kv, row)
 		pair += 1
 		if pair == 2 {
@@ -85,7 +117,7 @@ func DiskRead(filename string, database memory.ShardedCache, index int) error {
 	}
 
 	count := rowCount / 2
-	log.Printf("Restored database snapshot id=%d containing %d key(s)\n", index, count)
+	log.Printf("Restored database snapshot id=%s containing %d key(s)\n", name, count)
 	return nil
 }
 
@@ -93,35 +125,44 @@ func DiskRead(filename string, database memory.ShardedCache, index int) error {
 func SaveState() {
 	var wg sync.WaitGroup
 
-	fileNames := CreateLabels()
-	wg.Add(config.MemoryCacheContainerSize)
-	for index, fileName := range fileNames {
-		database := *memory.Container[index]
-		go func(index int, fileName string) {
+	names := memory.Container.Names()
+	wg.Add(len(names))
+	for _, name := range names {
+		database, _ := memory.Container.Load(name)
+		go func(name string) {
 			defer wg.Done()
-			if err := DiskWrite(fileName, database, index); err != nil {
-				log.Printf("Skipped saving database snapshot id=%d: %s\n", index, err)
+			if err := DiskWrite(CreateLabel(name), database, name); err != nil {
+				log.Printf("Skipped saving database snapshot id=%s: %s\n", name, err)
 			}
-		}(index, fileName)
+		}(name)
 	}
 
 	wg.Wait()
 }
 
-// RestoreState(): Restores the previous state of all databases.
+// RestoreState(): Restores the previous state of all databases, creating databases that only exist on disk.
 func RestoreState() {
 	var wg sync.WaitGroup
 
-	fileNames := CreateLabels()
-	wg.Add(config.MemoryCacheContainerSize)
-	for index, fileName := range fileNames {
-		database := *memory.Container[index]
-		go func(index int, fileName string) {
+	for _, name := range FindLabels() {
+		if _, ok := memory.Container.Load(name); ok {
+			continue
+		}
+		if _, err := memory.Container.Create(name); err != nil {
+			log.Printf("Skipped creating database id=%s: %s\n", name, err)
+		}
+	}
+
+	names := memory.Container.Names()
+	wg.Add(len(names))
+	for _, name := range names {
+		database, _ := memory.Container.Load(name)
+		go func(name string) {
 			defer wg.Done()
-			if err := DiskRead(fileName, database, index); err != nil {
-				log.Printf("Skipped restoring database snapshot id=%d: %s\n", index, err)
+			if err := DiskRead(CreateLabel(name), database, name); err != nil {
+				log.Printf("Skipped restoring database snapshot id=%s: %s\n", name, err)
 			}
-		}(index, fileName)
+		}(name)
 	}
 
 	wg.Wait()
@@ -1,10 +1,147 @@
 package writer
 
-import "strings"
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
 
-// BuildResponse(): Assembles the individual sub-responses into a singular response for the writer.
-func BuildResponse(pieces []string) []uint8 {
-	delimiter := ""
-	response := strings.Join(pieces, delimiter) // Join() uses a strings.Builder under the hood
-	return []uint8(response)
+	"lj.com/valhaj/internal/config"
+)
+
+// Nil is the line of an absent value, e.g. of a missing key. Tells it apart from an empty value with both protocols.
+const Nil = "$-1"
+
+var inlineReplacer = strings.NewReplacer("\r", " ", "\n", " ")
+
+// Writer buffers the replies of a session. They're flushed once the pipelined requests were executed, so a pipeline is answered with few syscalls.
+// A reply is either a single element ('!1') or an array started by Array() or Map(), followed by its elements. Replies to Redis clients are encoded in RESP instead.
+type Writer struct {
+	bw       *bufio.Writer
+	protocol int // 1 (line-based) or 2 (length-prefixed)
+	resp     int // RESP version (2 or 3) of the current reply, 0 otherwise
+	pending  int // Elements of the current array that weren't written yet, RESP doesn't count them
+	err      error
+}
+
+// NewWriter(): Creates a new writer buffering the replies for the connection.
+func NewWriter(conn net.Conn) *Writer {
+	return &Writer{
+		bw:       bufio.NewWriterSize(conn, config.WriterBufferSize),
+		protocol: 1,
+	}
+}
+
+// SetProtocol(): Sets the protocol version values are encoded with, see Bulk().
+func (w *Writer) SetProtocol(protocol int) {
+	w.protocol = protocol
+}
+
+// SetRESP(): Encodes the following replies with the given RESP version, 0 uses the protocol of the session.
+func (w *Writer) SetRESP(version int) {
+	w.resp = version
+}
+
+// OK(): Writes a '+OK' status.
+func (w *Writer) OK() {
+	w.Status("OK")
+}
+
+// Status(): Writes a status, e.g. '+PONG'.
+func (w *Writer) Status(status string) {
+	w.element("+"+status, false)
+}
+
+// Error(): Writes an error. Line breaks are replaced, as client data may be quoted in the message.
+func (w *Writer) Error(message string) {
+	w.element("-ERR "+inlineReplacer.Replace(message), false)
+}
+
+// Bulk(): Writes a value. Protocol 2 and RESP prefix it with its length ('$<length>\r\n'), so it may contain any bytes.
+func (w *Writer) Bulk(value string) {
+	w.element(value, true)
+}
+
+// Nil(): Writes an absent value, e.g. of a missing key. RESP3 encodes it as null ('_').
+func (w *Writer) Nil() {
+	if w.resp >= 3 {
+		w.element("_", false)
+		return
+	}
+	w.element(Nil, false)
+}
+
+// Int(): Writes an integer.
+func (w *Writer) Int(n int) {
+	w.element(":"+strconv.Itoa(n), false)
+}
+
+// Array(): Starts a reply of n elements, which are written by the following calls.
+func (w *Writer) Array(n int) {
+	w.header('*', n)
+}
+
+// Map(): Starts a reply of n pairs of keys and values, which are written by the following calls.
+// It's a map with RESP3, otherwise an array of 2n elements.
+func (w *Writer) Map(n int) {
+	if w.resp >= 3 {
+		w.header('%', n)
+		return
+	}
+	w.header('*', 2*n)
+}
+
+// Flush(): Writes the buffered replies to the connection.
+func (w *Writer) Flush() error {
+	if err := w.bw.Flush(); err != nil && w.err == nil {
+		w.err = err
+	}
+	return w.err
+}
+
+// Err(): Returns the first error that occurred while writing, the connection should be closed then.
+func (w *Writer) Err() error {
+	return w.err
+}
+
+// element(): Writes an element of the current array, or a reply of its own outside of an array.
+func (w *Writer) element(line string, bulk bool) {
+	if w.resp == 0 {
+		if w.pending == 0 {
+			w.count('!', 1)
+		} else {
+			w.pending--
+		}
+	}
+
+	if bulk && (w.protocol >= 2 || w.resp != 0) {
+		w.count('$', len(line))
+	}
+	w.write(line)
+	w.write("\r\n")
+}
+
+// header(): Writes the count of an array, with the given RESP type. The count of a reply is always '!<count>' otherwise.
+func (w *Writer) header(kind byte, n int) {
+	if w.resp == 0 {
+		kind = '!'
+		w.pending = n
+	}
+	w.count(kind, n)
+}
+
+// count(): Writes a '<kind><n>\r\n' line.
+func (w *Writer) count(kind byte, n int) {
+	if err := w.bw.WriteByte(kind); err != nil && w.err == nil {
+		w.err = err
+	}
+	w.write(strconv.Itoa(n))
+	w.write("\r\n")
+}
+
+// write(): Writes to the buffer.
+func (w *Writer) write(s string) {
+	if _, err := w.bw.WriteString(s); err != nil && w.err == nil {
+		w.err = err
+	}
 }
@@ -0,0 +1,57 @@
+package writer
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+// bufferConn collects the written data.
+type bufferConn struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (c *bufferConn) Write(b []byte) (int, error) {
+	return c.buf.Write(b)
+}
+
+func TestWriter(t *testing.T) {
+	reply := func(w *Writer) {
+		w.Array(3)
+		w.Bulk("a b")
+		w.Nil()
+		w.Int(5)
+		w.Map(1)
+		w.Bulk("key")
+		w.Bulk("")
+		w.Status("PONG")
+		w.Error("no\r\nbreaks")
+	}
+	tests := []struct {
+		name     string
+		protocol int
+		resp     int
+		want     string
+	}{
+		{"protocol 1", 1, 0, "!3\r\na b\r\n$-1\r\n:5\r\n!2\r\nkey\r\n\r\n!1\r\n+PONG\r\n!1\r\n-ERR no  breaks\r\n"},
+		{"protocol 2", 2, 0, "!3\r\n$3\r\na b\r\n$-1\r\n:5\r\n!2\r\n$3\r\nkey\r\n$0\r\n\r\n!1\r\n+PONG\r\n!1\r\n-ERR no  breaks\r\n"},
+		{"RESP2", 1, 2, "*3\r\n$3\r\na b\r\n$-1\r\n:5\r\n*2\r\n$3\r\nkey\r\n$0\r\n\r\n+PONG\r\n-ERR no  breaks\r\n"},
+		{"RESP3", 1, 3, "*3\r\n$3\r\na b\r\n_\r\n:5\r\n%1\r\n$3\r\nkey\r\n$0\r\n\r\n+PONG\r\n-ERR no  breaks\r\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn := &bufferConn{}
+			w := NewWriter(conn)
+			w.SetProtocol(test.protocol)
+			w.SetRESP(test.resp)
+			reply(w)
+			if err := w.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			if got := conn.buf.String(); got != test.want {
+				t.Fatalf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
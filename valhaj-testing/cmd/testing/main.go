@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"log"
 	"net"
 	"slices"
@@ -16,8 +17,10 @@ var TotalCommands, PassedCommands, FailedCommands int
 var TotalAsserts, PassedAsserts, FailedAsserts int
 var Conn net.Conn
 var Read *reader.Reader
+var AdminAddress = flag.String("admin", "../valhaj-server/sockets/admin.sock", "UNIX socket of the admin listener")
 
 func main() {
+	flag.Parse()
 	start := time.Now()
 
 	// Run the timed test suite
@@ -51,7 +54,8 @@ func Eval(command string, expectedOutput []string, contains bool) {
 		return
 	}
 
-	responses, err := database.Exec(Conn, Read, command)
+	result, err := database.Exec(Conn, Read, command)
+	responses := result.Strings() // Nil is '$-1', like with protocol 1
 
 	var comparison bool
 	if contains { // We only require one item to match our expected result
@@ -82,7 +86,8 @@ func Assert(command string, expectedOutput []string, contains bool) {
 		return
 	}
 
-	responses, err := database.Exec(Conn, Read, command)
+	result, err := database.Exec(Conn, Read, command)
+	responses := result.Strings() // Nil is '$-1', like with protocol 1
 
 	var comparison bool
 	if contains { // We only require one item to match our expected result
@@ -110,21 +115,95 @@ func Setup(command string) {
 	log.Printf("\x1b[90mSetup: '%s'.\x1b[39m", command)
 }
 
+// WaitFor(): Repeats the command until one item of its output matches, e.g. until a background task finished. Gives up after the timeout,
+// so the following test fails instead.
+func WaitFor(command string, expectedOutput string, timeout time.Duration) {
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		result, err := database.Exec(Conn, Read, command)
+		if err == nil && slices.Contains(result.Strings(), expectedOutput) {
+			break
+		}
+	}
+	log.Printf("\x1b[90mWait: '%s' for '%s'.\x1b[39m", command, expectedOutput)
+}
+
 func RunTests() {
 	/* Setup */
 	var err error
-	Conn, err = connection.Connect("tcp", "127.0.0.1:6380")
+	Conn, err = connection.Connect("unix", *AdminAddress) // Administrative commands are only available via the admin listener
 	if err != nil {
 		log.Fatalf("error: %s", err)
 	}
 	Read = reader.NewReader(Conn)
 
 	/* Commands */
+	Context("auth") // The test server runs without a users file
+	Eval("auth secret", []string{"-ERR authentication is disabled, no users are configured"}, false)
+	Eval("auth user secret", []string{"-ERR authentication is disabled, no users are configured"}, false)
+	Eval("auth", []string{"-ERR wrong number of arguments for 'auth' command"}, false)
+
+	Context("hello")
+	Eval("hello", []string{"server:valhaj"}, true)
+	Eval("hello", []string{"database:0"}, true)
+	Eval("hello auth user secret", []string{"-ERR authentication is disabled, no users are configured"}, false)
+	Eval("hello user secret foo", []string{"-ERR wrong syntax for 'hello' command"}, false)
+	Eval("hello auth", []string{"-ERR wrong number of arguments for 'hello' command"}, false)
+	Eval("hello 1", []string{"protocol:1"}, true)
+	Eval("hello 3", []string{"-ERR unsupported protocol version"}, false)
+	Eval("hello 2 auth user secret", []string{"-ERR authentication is disabled, no users are configured"}, false)
+	Assert("hello", []string{"protocol:1"}, true) // Failed handshakes don't switch the protocol
+
+	Context("privileges") // Clients of the regular listener, even local ones, aren't privileged without authentication
+	adminConn, adminRead := Conn, Read
+	Conn, err = connection.Connect("tcp", "127.0.0.1:6380")
+	if err != nil {
+		log.Fatalf("error: %s", err)
+	}
+	Read = reader.NewReader(Conn)
+	Eval("flush", []string{"-ERR insufficient permissions"}, false)
+	Eval("shutdown", []string{"-ERR insufficient permissions"}, false)
+	Eval("keys *", []string{"-ERR insufficient permissions"}, false)
+	Eval("db create 99", []string{"-ERR insufficient permissions"}, false)
+	Eval("echo hi", []string{"hi"}, false)
+	Read.Reset()
+	if err := connection.Disconnect(Conn); err != nil {
+		log.Fatalf("error: %s", err)
+	}
+	Conn, Read = adminConn, adminRead
+
+	Context("acl")
+	Eval("acl whoami", []string{"-ERR authentication is disabled, no users are configured"}, false)
+	Eval("acl setuser alice on >secret +@read", []string{"-ERR authentication is disabled, no users are configured"}, false)
+	Eval("acl foo", []string{"-ERR unknown subcommand 'foo'"}, false)
+	Eval("acl getuser", []string{"-ERR wrong number of arguments for 'acl' command"}, false)
+	Eval("acl", []string{"-ERR wrong number of arguments for 'acl' command"}, false)
+
 	Context("select")
 	Eval("select 0", []string{"+OK"}, false)
-	Eval("select 100", []string{"-ERR index value is out of bounds"}, false)
+	Eval("select 100", []string{"-ERR no such database"}, false)
 	Eval("select", []string{"-ERR wrong number of arguments for 'select' command"}, false)
-	Eval("select abc", []string{"-ERR index value is not an integer"}, false)
+	Eval("select abc", []string{"-ERR no such database"}, false)
+
+	Context("db")
+	Eval("db list", []string{"1"}, true)
+	Eval("db create orders", []string{"+OK"}, false)
+	Eval("db create orders", []string{"-ERR database already exists"}, false)
+	Eval("db create ../orders", []string{"-ERR invalid database name"}, false)
+	Eval("db list", []string{"orders"}, true)
+	Eval("select orders", []string{"+OK"}, false)
+	Setup("set 96000 a")
+	Eval("info", []string{"memory_active_database:orders"}, true)
+	Eval("info keyspace", []string{"keyspace_dborders:keys=1,expires=0"}, true)
+	Eval("db drop orders", []string{"+OK"}, false)
+	Eval("get 96000", []string{"-ERR selected database no longer exists"}, false)
+	Eval("select orders", []string{"-ERR no such database"}, false)
+	Eval("select 0", []string{"+OK"}, false)
+	Eval("db drop orders", []string{"-ERR no such database"}, false)
+	Eval("db drop 0", []string{"-ERR the default database can't be dropped"}, false)
+	Eval("db list 0", []string{"-ERR wrong number of arguments for 'db' command"}, false)
+	Eval("db create", []string{"-ERR wrong number of arguments for 'db' command"}, false)
+	Eval("db foo", []string{"-ERR unknown subcommand 'foo'"}, false)
+	Eval("db", []string{"-ERR wrong number of arguments for 'db' command"}, false)
 
 	Context("flushall")
 	Eval("flushall", []string{"+OK"}, false)
@@ -142,8 +221,32 @@ func RunTests() {
 	Eval("move 454545 1", []string{"+OK"}, false)
 	Setup("set 454545 hello")
 	Eval("move 454545 1", []string{"-ERR key already exists in destination database"}, false)
+	Eval("move 454545 nowhere", []string{"-ERR no such database"}, false)
 	Eval("move 454545 0", []string{"+OK"}, false)
 
+	Context("swapdb")
+	Setup("select 1")
+	Setup("set 454546 hello")
+	Eval("swapdb 0 1", []string{"+OK"}, false)
+	Assert("get 454546", []string{"$-1"}, false)
+	Assert("get 454545", []string{"hello"}, false)
+	Setup("select 0")
+	Assert("get 454546", []string{"hello"}, false)
+	Eval("swapdb 1 0", []string{"+OK"}, false)
+	Assert("get 454546", []string{"$-1"}, false)
+	Eval("swapdb 0 100", []string{"-ERR no such database"}, false)
+	Eval("swapdb abc 0", []string{"-ERR no such database"}, false)
+	Eval("swapdb 0", []string{"-ERR wrong number of arguments for 'swapdb' command"}, false)
+
+	Context("dbsize")
+	Setup("select 2")
+	Eval("dbsize", []string{":0"}, false)
+	Setup("set 454547 hello")
+	Eval("dbsize", []string{":1"}, false)
+	Setup("del 454547")
+	Setup("select 0")
+	Eval("dbsize 0", []string{"-ERR wrong number of arguments for 'dbsize' command"}, false)
+
 	Context("mset")
 	Eval("mset 500 hi 600 bye", []string{"+OK"}, false)
 	Eval("mset 500 hi 600 bye 700", []string{"-ERR wrong number of arguments for 'mset' command"}, false)
@@ -151,20 +254,20 @@ func RunTests() {
 
 	Context("mget")
 	Eval("mget 500 600", []string{"hi", "bye"}, false)
-	Eval("mget 800 900", []string{"", ""}, false)
+	Eval("mget 800 900", []string{"$-1", "$-1"}, false)
 	Eval("mget", []string{"-ERR wrong number of arguments for 'mget' command"}, false)
 
 	Context("get")
 	Eval("get 600", []string{"bye"}, false)
-	Eval("get 900", []string{""}, false)
+	Eval("get 900", []string{"$-1"}, false)
 	Eval("get", []string{"-ERR wrong number of arguments for 'get' command"}, false)
 
 	Context("set")
 	Eval("set 600 hi", []string{"+OK"}, false)
 	Eval("set 600 hi ???", []string{"-ERR wrong syntax for 'set' command"}, false)
 	Eval("set 600", []string{"-ERR wrong number of arguments for 'set' command"}, false)
-	Eval("set 600 hi nx", []string{""}, false)
-	Eval("set 600 hi nx", []string{""}, false)
+	Eval("set 600 hi nx", []string{"$-1"}, false)
+	Eval("set 600 hi nx", []string{"$-1"}, false)
 	Eval("set 600 hi nx xx", []string{"-ERR wrong syntax for 'set' command"}, false)
 	// TODO: More 'SET' tests...
 
@@ -187,6 +290,46 @@ func RunTests() {
 	Eval("decr 90000 -1", []string{"-ERR inverse/non operations are discouraged"}, false)
 	Eval("decr 600", []string{"-ERR value is either not an integer or too large"}, false)
 
+	Context("incr (bounded)")
+	Eval("incr 2001 2 max 3", []string{"2"}, false)
+	Eval("incr 2001 2 max 3", []string{"-ERR value would exceed the counter bounds"}, false)
+	Assert("get 2001", []string{"2"}, false)
+	Eval("incr 2001 2 max 3 saturate", []string{"3"}, false)
+	Eval("incr 2001 max", []string{"-ERR wrong syntax for counter options"}, false)
+	Eval("incr 2001 min 5 max 1", []string{"-ERR counter bounds are either not integers or invalid"}, false)
+	Eval("incr 2003 max -1", []string{"-ERR value would exceed the counter bounds"}, false)
+	Assert("exists 2003", []string{":0"}, false) // Not created by a failed increment
+
+	Context("decr (bounded)")
+	Eval("decr 2001 min 0", []string{"2"}, false)
+	Eval("decr 2001 5 min 0", []string{"-ERR value would exceed the counter bounds"}, false)
+	Eval("decr 2001 5 min 0 saturate", []string{"0"}, false)
+
+	Context("incrby")
+	Eval("incrby 2002 5", []string{"5"}, false)
+	Eval("incrby 2002 -7", []string{"-2"}, false)
+	Eval("incrby 2002 -7 min -5 saturate", []string{"-5"}, false)
+	Eval("incrby 2002 f", []string{"-ERR increment is either not an integer or too large"}, false)
+	Eval("incrby 2002", []string{"-ERR wrong number of arguments for 'incrby' command"}, false)
+	Eval("incrby 9000 1", []string{"-ERR value is either not an integer or too large"}, false)
+
+	Context("decrby")
+	Eval("decrby 2002 -10", []string{"5"}, false)
+	Eval("decrby 2002 6", []string{"-1"}, false)
+	Eval("decrby 2002 f", []string{"-ERR decrement is either not an integer or too large"}, false)
+	Eval("decrby 600 1", []string{"-ERR value is either not an integer or too large"}, false)
+
+	Context("incrbyfloat")
+	Eval("incrbyfloat 2003 10.5", []string{"10.5"}, false)
+	Eval("incrbyfloat 2003 0.1", []string{"10.6"}, false)
+	Eval("incrbyfloat 2003 -5.6", []string{"5"}, false)
+	Eval("incrbyfloat 2003 1e3", []string{"1005"}, false)
+	Eval("incrbyfloat 2003 abc", []string{"-ERR increment is not a valid float"}, false)
+	Eval("incrbyfloat 600 1", []string{"-ERR value is not a valid float"}, false)
+	Setup("set 2004 1e308")
+	Eval("incrbyfloat 2004 1e308", []string{"-ERR increment would produce NaN or Infinity"}, false)
+	Setup("del 2001 2002 2003 2004")
+
 	Context("append")
 	Eval("append 80000 :)", []string{":)"}, false)
 	Eval("append 80000 (:", []string{":)(:"}, false)
@@ -199,11 +342,37 @@ func RunTests() {
 	Eval("len 80000", []string{"$6"}, false)
 	Eval("len 80000 600 128", []string{"$6", "$2", "$-1"}, false)
 
+	Context("strlen")
+	Eval("strlen 80000", []string{":6"}, false)
+	Eval("strlen 128", []string{":0"}, false)
+	Eval("strlen 80000 600", []string{"-ERR wrong number of arguments for 'strlen' command"}, false)
+
+	Context("getrange")
+	Eval("getrange 80000 0 1", []string{"! "}, false)
+	Eval("getrange 80000 -4 -1", []string{":)(:"}, false)
+	Eval("getrange 80000 2 100", []string{":)(:"}, false)
+	Eval("getrange 80000 4 2", []string{""}, false)
+	Eval("getrange 128 0 1", []string{""}, false)
+	Eval("getrange 80000 a 1", []string{"-ERR value is not an integer or out of range"}, false)
+
+	Context("setrange")
+	Setup("set 81000 hello")
+	Eval("setrange 81000 0 J", []string{":5"}, false)
+	Assert("get 81000", []string{"Jello"}, false)
+	Eval("setrange 81000 5 \" world\"", []string{":11"}, false)
+	Assert("get 81000", []string{"Jello world"}, false)
+	Eval("setrange 81001 2 hi", []string{":4"}, false)
+	Assert("strlen 81001", []string{":4"}, false)
+	Eval("setrange 81000 -1 hi", []string{"-ERR offset is not an integer or out of range"}, false)
+	Eval("setrange 81000 9223372036854775807 a", []string{"-ERR offset is not an integer or out of range"}, false)
+	Eval("setrange 81000 536870911 ab", []string{"-ERR offset is not an integer or out of range"}, false)
+	Setup("del 81000 81001")
+
 	Context("rename")
 	Eval("rename 880000 70000", []string{"-ERR no such key"}, false)
 	Eval("rename 80000 70000", []string{"+OK"}, false)
 	Assert("get 70000", []string{"! :)(:"}, false)
-	Assert("get 80000", []string{""}, false)
+	Assert("get 80000", []string{"$-1"}, false)
 
 	Context("copy")
 	Eval("copy 80000 70000", []string{"-ERR no such key"}, false)
@@ -219,13 +388,13 @@ func RunTests() {
 	Context("getset")
 	Eval("getset 70000 bye", []string{"hello"}, false)
 	Assert("get 70000", []string{"bye"}, false)
-	Eval("getset 70707 bye", []string{""}, false)
+	Eval("getset 70707 bye", []string{"$-1"}, false)
 	Assert("get 70707", []string{"bye"}, false)
 
 	Context("getdel")
 	Eval("getdel 70707", []string{"bye"}, false)
-	Assert("get 70707", []string{""}, false)
-	Eval("getdel 70707", []string{""}, false)
+	Assert("get 70707", []string{"$-1"}, false)
+	Eval("getdel 70707", []string{"$-1"}, false)
 
 	Context("del")
 	Eval("del 70000 70707", []string{":1"}, false)
@@ -235,23 +404,206 @@ func RunTests() {
 	Eval("exists 70000 70707", []string{":0"}, false)
 	Eval("exists 80000 70000 600", []string{":2"}, false)
 
+	Context("pfadd")
+	Eval("pfadd 90900 a b c", []string{":1"}, false)
+	Eval("pfadd 90900 a", []string{":0"}, false)
+	Assert("pfcount 90900", []string{":3"}, false)
+	Eval("memory usage 90900", []string{":117"}, false) // Stored sparse, 3 registers of 4 bytes
+	Eval("pfadd 90903", []string{":1"}, false)          // Creates an empty hyperloglog
+	Eval("pfadd 90903", []string{":0"}, false)
+	Assert("pfcount 90903", []string{":0"}, false)
+	Eval("pfadd 80000 a", []string{"-ERR value is not a valid hyperloglog"}, false)
+	Eval("pfadd", []string{"-ERR wrong number of arguments for 'pfadd' command"}, false)
+
+	Context("pfcount")
+	Setup("pfadd 90901 c d e")
+	Eval("pfcount 90900 90901", []string{":5"}, false)
+	Eval("pfcount 90902", []string{":0"}, false)
+	Eval("pfcount 80000", []string{"-ERR value is not a valid hyperloglog"}, false)
+
+	Context("pfmerge")
+	Eval("pfmerge 90902 90900 90901", []string{"+OK"}, false)
+	Assert("pfcount 90902", []string{":5"}, false)
+	Eval("pfmerge 80000 90900", []string{"-ERR value is not a valid hyperloglog"}, false)
+	Assert("get 80000", []string{"hello"}, false)
+
+	Context("setbit")
+	Eval("setbit 91000 7 1", []string{":0"}, false)
+	Eval("setbit 91000 7 1", []string{":1"}, false)
+	Eval("setbit 91000 20 1", []string{":0"}, false)
+	Eval("setbit 91000 -1 1", []string{"-ERR bit offset is not an integer or out of range"}, false)
+	Eval("setbit 91000 1 2", []string{"-ERR bit is not an integer or out of range"}, false)
+
+	Context("getbit")
+	Eval("getbit 91000 7", []string{":1"}, false)
+	Eval("getbit 91000 6", []string{":0"}, false)
+	Eval("getbit 91000 1000", []string{":0"}, false)
+
+	Context("bitcount")
+	Eval("bitcount 91000", []string{":2"}, false)
+	Eval("bitcount 91000 0 0", []string{":1"}, false)
+	Eval("bitcount 91000 -1 -1", []string{":1"}, false)
+	Eval("bitcount 91000 8 20 bit", []string{":1"}, false)
+	Eval("bitcount 91001", []string{":0"}, false)
+	Eval("bitcount 91000 0", []string{"-ERR wrong number of arguments for 'bitcount' command"}, false)
+
+	Context("bitpos")
+	Eval("bitpos 91000 1", []string{":7"}, false)
+	Eval("bitpos 91000 0", []string{":0"}, false)
+	Eval("bitpos 91000 1 1", []string{":20"}, false)
+	Eval("bitpos 91000 1 8 19 bit", []string{":-1"}, false)
+	Eval("bitpos 91001 0", []string{":0"}, false)
+	Eval("bitpos 91001 1", []string{":-1"}, false)
+
+	Context("bitop")
+	Setup("set 91002 abc")
+	Setup("set 91003 ab")
+	Eval("bitop or 91004 91002 91003", []string{":3"}, false)
+	Assert("get 91004", []string{"abc"}, false)
+	Eval("bitop and 91004 91002 91001", []string{":3"}, false)
+	Assert("bitcount 91004", []string{":0"}, false)
+	Eval("bitop not 91004 91002 91003", []string{"-ERR 'BITOP NOT' requires exactly one source key"}, false)
+	Eval("bitop nand 91004 91002", []string{"-ERR unknown option"}, false)
+
+	Context("scan")
+	Eval("scan 0 count 100000 match 9090[01]", []string{"0", "90900"}, true)
+	Eval("scan 0 count 100000 match 9090[01]", []string{"90901"}, true)
+	Eval("scan 0 count 100000 match 9090? type hash", []string{"0"}, false)
+	Eval("scan 0 count 100000 match nothing*", []string{"0"}, false)
+	Eval("scan 100000", []string{"-ERR invalid cursor"}, false)
+	Eval("scan 0 count 0", []string{"-ERR wrong syntax for 'scan' command"}, false)
+	Eval("scan", []string{"-ERR wrong number of arguments for 'scan' command"}, false)
+
+	Context("keys")
+	Eval("keys 9090?", []string{"90902"}, true)
+	Eval("keys", []string{"-ERR wrong number of arguments for 'keys' command"}, false)
+
+	Context("randomkey")
+	Setup("select 2")
+	Eval("randomkey", []string{"$-1"}, false)
+	Setup("set 92000 hi")
+	Eval("randomkey", []string{"92000"}, false)
+	Setup("del 92000")
+	Setup("select 0")
+
+	Context("memory")
+	Setup("set 93000 123")
+	Eval("memory usage 93000", []string{":104"}, false) // 5 + 3 bytes and the per-key overhead
+	Eval("memory usage 93001", []string{"$-1"}, false)
+	Eval("memory stats 93000", []string{"-ERR unknown subcommand 'stats'"}, false)
+	Eval("memory usage", []string{"-ERR wrong number of arguments for 'memory' command"}, false)
+
+	Context("object")
+	Eval("object encoding 93000", []string{"int"}, false)
+	Eval("object encoding 90900", []string{"hyperloglog"}, false)
+	Eval("object encoding 80000", []string{"raw"}, false)
+	Eval("object idletime 93000", []string{":0"}, false)
+	Eval("object freq 93000", []string{":5"}, false)
+	Eval("object freq 93001", []string{"$-1"}, false)
+	Eval("object refcount 93000", []string{"-ERR unknown subcommand 'refcount'"}, false)
+	Setup("del 93000")
+
 	Context("info")
 	Eval("info", []string{"release_os_arch:linux-amd64"}, true) // We use some settings that should hardly ever change
-	Eval("info", []string{"memory_database_shards:50"}, true)
+	Eval("info", []string{"memory_database_shards:64"}, true)
 	Eval("info", []string{"memory_logical_databases:3"}, true)
 	Eval("info", []string{"memory_active_database:0"}, true) // This we know for sure
+	Setup("select 2")
+	Setup("set 454548 hello ex 100")
+	Setup("select 0")
+	Eval("info keyspace", []string{"keyspace_db2:keys=1,expires=1"}, true)
+	Eval("info all", []string{"memory_active_database:0"}, true)
+	Eval("info all", []string{"keyspace_db2:keys=1,expires=1"}, true)
+	Eval("info", []string{"memory_evicted_keys:0"}, true)
+	Eval("info memory", []string{"memory_max_bytes:0"}, true)
+	Eval("info memory", []string{"memory_eviction_policy:noeviction"}, true)
+	Eval("info nothing", []string{"-ERR unknown section 'nothing'"}, false)
+	Setup("select 2")
+	Setup("incr 454549")
+	Setup("set 454549 5 ex 100")
+	Setup("incr 454549")
+	Setup("set 454548 hello") // Overwriting removes the expiration, incrementing keeps it
+	Setup("select 0")
+	Eval("info keyspace", []string{"keyspace_db2:keys=2,expires=1"}, true)
+	Setup("select 2")
+	Setup("del 454548 454549")
+	Setup("select 0")
 
 	Context("echo")
 	Eval("echo \"hello, world!\"", []string{"hello, world!"}, false)
 	Eval("echo hi bye", []string{"-ERR wrong number of arguments for 'echo' command"}, false)
 	Eval("echo", []string{"-ERR wrong number of arguments for 'echo' command"}, false)
 
+	Context("ping")
+	Eval("ping", []string{"+PONG"}, false)
+	Eval("ping \"hello, world!\"", []string{"hello, world!"}, false)
+	Eval("ping hi bye", []string{"-ERR wrong number of arguments for 'ping' command"}, false)
+
+	Context("debug")
+	Setup("select 2")
+	Eval("debug shards", []string{"memory_shard_keys_max:0"}, true)
+	Eval("debug shards", []string{"memory_shard_imbalance:0.00"}, true)
+	Eval("info memory", []string{"memory_shard_keys_min:0"}, true)
+	Setup("set 94000 a")
+	Eval("debug shards", []string{"memory_shard_keys_max:1"}, true)
+	Eval("info", []string{"memory_shard_imbalance:64.00"}, true)
+	Setup("del 94000")
+	Setup("select 0")
+	Eval("debug foo", []string{"-ERR unknown subcommand 'foo'"}, false)
+	Eval("debug", []string{"-ERR wrong number of arguments for 'debug' command"}, false)
+
+	Context("reshard")
+	Setup("select 2")
+	Setup("set 95000 a")
+	Setup("set 95001 b")
+	Eval("reshard 64", []string{"+OK"}, false) // Same shard count, nothing to migrate
+	Eval("reshard 4", []string{"+OK"}, false)
+	Eval("get 95000", []string{"a"}, false) // Keys are served from both layouts while migrating
+	Eval("scan 0 count 100000", []string{"95001"}, true)
+	Eval("dbsize", []string{":2"}, false)
+	WaitFor("info", "memory_resharding_target_shards:0", 5*time.Second) // Migrates in the background
+	Eval("info", []string{"memory_resharding_target_shards:0"}, true)
+	Eval("info", []string{"memory_database_shards:4"}, true)
+	Eval("reshard 0", []string{"-ERR shard count must be between 1 and 65536"}, false)
+	Eval("reshard 65537", []string{"-ERR shard count must be between 1 and 65536"}, false)
+	Eval("reshard abc", []string{"-ERR shard count must be between 1 and 65536"}, false)
+	Eval("reshard", []string{"-ERR wrong number of arguments for 'reshard' command"}, false)
+	Setup("del 95000")
+	Setup("del 95001")
+	Setup("reshard 64") // The other tests expect the default shard count, e.g. when running them again
+	WaitFor("info", "memory_resharding_target_shards:0", 5*time.Second)
+	Assert("info", []string{"memory_database_shards:64"}, true)
+	Setup("select 0")
+
 	Context("flush")
 	Eval("flush", []string{"+OK"}, false)
 	Assert("info", []string{"keyspace_keys:0"}, true)
 
 	// TODO: 'shutdown' command
 
+	Context("namespace") // A namespace can't be left, hence near the end
+	Setup("set 97000 outside")
+	Eval("namespace team-a", []string{"+OK"}, false)
+	Eval("namespace", []string{"team-a"}, false)
+	Eval("get 97000", []string{"$-1"}, false)
+	Setup("mset 97000 a 97001 b")
+	Eval("mget 97000 97001", []string{"a", "b"}, false)
+	Eval("keys 9700*", []string{"97000"}, true)
+	Eval("scan 0 count 100000", []string{"97001"}, true)
+	Eval("rename 97001 97002", []string{"+OK"}, false)
+	Eval("exists 97000 97001 97002", []string{":2"}, false)
+	Eval("dbsize", []string{"-ERR command not allowed within a namespace"}, false)
+	Eval("info keyspace", []string{"-ERR section 'keyspace' not allowed within a namespace"}, false)
+	Eval("info all", []string{"-ERR section 'all' not allowed within a namespace"}, false)
+	Eval("flush", []string{"-ERR command not allowed within a namespace"}, false)
+	Eval("namespace team:a", []string{"-ERR invalid namespace"}, false)
+	Eval("namespace a b", []string{"-ERR wrong number of arguments for 'namespace' command"}, false)
+	Eval("namespace team-b", []string{"+OK"}, false)
+	Eval("exists 97000", []string{":0"}, false)
+	Setup("set 97003 c")
+	Eval("randomkey", []string{"97003"}, false)
+	Eval("keys *", []string{"97003"}, false)
+
 	Context("quit") // Moved this down, hence a little out of order, see 'commands' package
 	Eval("quit", []string{"+OK"}, false)
 